@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxApiBody = 1 << 20
+
+func writeJson(w http.ResponseWriter, status int, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func apiError(w http.ResponseWriter, status int, format string, a ...any) error {
+	return writeJson(w, status, struct {
+		Error string `json:"error"`
+	}{fmt.Sprintf(format, a...)})
+}
+
+func readJsonLink(r *http.Request) (Link, error) {
+	l := Link{}
+	err := json.NewDecoder(io.LimitReader(r.Body, maxApiBody)).Decode(&l)
+	return l, err
+}
+
+// author returns the user making the request, from the --author-header header.
+func (g *goHttp) author() string {
+	if *flagAuthorHeader == "" {
+		return ""
+	}
+	return strings.TrimSpace(g.R.Header.Get(*flagAuthorHeader))
+}
+
+// saveLinks persists a change made through the web interface or API.
+func saveLinks(db *LinkDB, changed []Link, removed []string) error {
+	if err := db.Save(changed, removed); err != nil {
+		return fmt.Errorf("Could not write to cache: %w", err)
+	}
+	return nil
+}
+
+// handleApiLinks serves /_/api/links and /_/api/links/<name>.
+func (g *goHttp) handleApiLinks(db *LinkDB, name string) error {
+	w, r := g.W, g.R
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			return writeJson(w, http.StatusOK, db.All())
+		case http.MethodPost:
+			if !*flagEdit {
+				return apiError(w, http.StatusForbidden, "Editing is disabled")
+			}
+			l, err := readJsonLink(r)
+			if err != nil {
+				return apiError(w, http.StatusBadRequest, "Could not parse link: %s", err)
+			}
+			if err := validateLink(&l); err != nil {
+				return apiError(w, http.StatusBadRequest, "%s", err)
+			}
+			l.Origin = originLocal
+			l.Author = g.author()
+			l, _, _, err = db.Edit("", l)
+			if err != nil {
+				return apiError(w, http.StatusConflict, "%s", err)
+			}
+			log.Printf("Created link go/%s -> %s\n", l.Display, l.Destination)
+			if err := saveLinks(db, []Link{l}, nil); err != nil {
+				return err
+			}
+			w.Header().Set("Location", "/_/api/links/"+url.PathEscape(l.Display))
+			return writeJson(w, http.StatusCreated, l)
+		}
+		w.Header().Set("Allow", "GET, POST")
+		return apiError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		l := db.Lookup(name)
+		if l == nil {
+			return apiError(w, http.StatusNotFound, "Link %s not found", name)
+		}
+		return writeJson(w, http.StatusOK, l)
+	case http.MethodPut:
+		if !*flagEdit {
+			return apiError(w, http.StatusForbidden, "Editing is disabled")
+		}
+		l, err := readJsonLink(r)
+		if err != nil {
+			return apiError(w, http.StatusBadRequest, "Could not parse link: %s", err)
+		}
+		if l.Display == "" {
+			l.Display = name
+			if existing := db.Lookup(name); existing != nil {
+				l.Display = existing.Display
+			}
+		}
+		if err := validateLink(&l); err != nil {
+			return apiError(w, http.StatusBadRequest, "%s", err)
+		}
+		l.Origin = originLocal
+		l.Author = g.author()
+		l, removed, added, err := db.Edit(name, l)
+		if err != nil {
+			return apiError(w, http.StatusConflict, "Can't save %s: %s", name, err)
+		}
+		status := http.StatusOK
+		if added {
+			status = http.StatusCreated
+		}
+		log.Printf("Saved link go/%s -> %s\n", l.Display, l.Destination)
+		if err := saveLinks(db, []Link{l}, removed); err != nil {
+			return err
+		}
+		return writeJson(w, status, l)
+	case http.MethodDelete:
+		if !*flagEdit {
+			return apiError(w, http.StatusForbidden, "Editing is disabled")
+		}
+		l, ok := db.Delete(name)
+		if !ok {
+			return apiError(w, http.StatusNotFound, "Link %s not found", name)
+		}
+		log.Printf("Deleted link go/%s\n", l.Display)
+		if err := saveLinks(db, nil, []string{l.Source}); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	w.Header().Set("Allow", "GET, PUT, DELETE")
+	return apiError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+}
+
+// handleApiClicks serves /_/api/clicks and /_/api/clicks/<name>.
+//
+// The list may be sorted with ?sort= (clicks, 7d, 30d or last) and restricted with
+// ?unused=<days> to the links not followed in that many days, e.g. to find links to prune.
+func (g *goHttp) handleApiClicks(db *LinkDB, name string) error {
+	w, r := g.W, g.R
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return apiError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+	now := time.Now()
+	if name != "" {
+		l := db.Lookup(name)
+		if l == nil {
+			return apiError(w, http.StatusNotFound, "Link %s not found", name)
+		}
+		c := db.Clicks(l.Source)
+		return writeJson(w, http.StatusOK, linkClicks{*l, c.Total, c.LastUsed, c.Since(now, 7), c.Since(now, 30)})
+	}
+
+	q := r.URL.Query()
+	sortBy := q.Get("sort")
+	if _, ok := clickSorts[sortBy]; sortBy != "" && !ok {
+		return apiError(w, http.StatusBadRequest, "Unknown sort '%s'; expected clicks, 7d, 30d or last", sortBy)
+	}
+	lcs := db.allLinkClicks(now, sortBy)
+	if q.Has("unused") {
+		days, err := strconv.Atoi(q.Get("unused"))
+		if err != nil || days < 0 {
+			return apiError(w, http.StatusBadRequest, "Invalid unused '%s'; expected a number of days", q.Get("unused"))
+		}
+		cutoff := now.AddDate(0, 0, -days)
+		lcs = slices.DeleteFunc(lcs, func(lc linkClicks) bool { return lc.LastUsed.After(cutoff) })
+	}
+	return writeJson(w, http.StatusOK, lcs)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// enableEdit sets --edit for the test.
+func enableEdit(t *testing.T) {
+	t.Helper()
+	edit := *flagEdit
+	*flagEdit = true
+	t.Cleanup(func() { *flagEdit = edit })
+}
+
+func TestApiLinks(t *testing.T) {
+	enableEdit(t)
+	db := &LinkDB{Store: &jsonStore{filepath.Join(t.TempDir(), "cache.json")}}
+
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		g := goHttp{W: rr, R: req}
+		if err := g.handleApiLinks(db, strings.Trim(strings.TrimPrefix(req.URL.Path, "/_/api/links"), "/")); err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+		return rr
+	}
+
+	tests := []struct {
+		desc   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"create", "POST", "/_/api/links", `{"display": "Foo-Bar", "destination": "http://example.org"}`, http.StatusCreated},
+		{"create duplicate", "POST", "/_/api/links", `{"display": "foobar", "destination": "http://example.org"}`, http.StatusConflict},
+		{"create invalid destination", "POST", "/_/api/links", `{"display": "baz", "destination": "example.org"}`, http.StatusBadRequest},
+		{"create reserved name", "POST", "/_/api/links", `{"display": "_baz", "destination": "http://example.org"}`, http.StatusBadRequest},
+		{"get canonicalized", "GET", "/_/api/links/foo.bar", "", http.StatusOK},
+		{"get missing", "GET", "/_/api/links/nope", "", http.StatusNotFound},
+		{"replace", "PUT", "/_/api/links/foobar", `{"destination": "http://example.com", "owner": "me"}`, http.StatusOK},
+		{"put new", "PUT", "/_/api/links/other", `{"destination": "http://example.net"}`, http.StatusCreated},
+		{"rename onto existing", "PUT", "/_/api/links/other", `{"display": "foo-bar", "destination": "http://example.net"}`, http.StatusConflict},
+		{"rename", "PUT", "/_/api/links/other", `{"display": "another", "destination": "http://example.net"}`, http.StatusOK},
+		{"delete", "DELETE", "/_/api/links/another", "", http.StatusNoContent},
+		{"delete missing", "DELETE", "/_/api/links/another", "", http.StatusNotFound},
+		{"bad method", "PATCH", "/_/api/links", "", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		if got := do(tc.method, tc.path, tc.body).Code; got != tc.want {
+			t.Errorf("%s: %s %s = HTTP %d, want %d", tc.desc, tc.method, tc.path, got, tc.want)
+		}
+	}
+
+	links := []Link{}
+	if err := json.NewDecoder(do("GET", "/_/api/links", "").Body).Decode(&links); err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Display != "Foo-Bar" || links[0].Destination != "http://example.com" || links[0].Owner != "me" {
+		t.Errorf("GET /_/api/links = %+v, want the single replaced Foo-Bar link", links)
+	}
+
+	cached := &LinkDB{Store: db.Store}
+	if err := cached.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cached.Lookup("foobar") == nil || cached.Len() != 1 {
+		t.Errorf("cache at %s does not contain the expected links", db.Store)
+	}
+}
+
+func TestCrossSiteEdit(t *testing.T) {
+	enableEdit(t)
+	db := &LinkDB{Store: &jsonStore{filepath.Join(t.TempDir(), "cache.json")}}
+	tests := []struct {
+		desc    string
+		method  string
+		path    string
+		headers map[string]string
+		want    int
+	}{
+		{"form from another site", "POST", "/_/edit", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"form from a sibling site", "POST", "/_/edit", map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"form from an old browser", "POST", "/_/edit", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"form from a sandboxed page", "POST", "/_/edit", map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"api from another site", "DELETE", "/_/api/links/foo", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"form from gohome", "POST", "/_/edit", map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://gohome"}, http.StatusSeeOther},
+		{"form from gohome in an old browser", "POST", "/_/edit", map[string]string{"Origin": "http://gohome"}, http.StatusSeeOther},
+		{"curl", "POST", "/_/edit", nil, http.StatusSeeOther},
+		{"link from another site", "GET", "/_/edit?name=foo", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, "http://gohome"+tc.path, strings.NewReader("display="+strings.ReplaceAll(tc.desc, " ", "-")+"&destination=http://example.org"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		g := goHttp{W: rr, R: req}
+		if err := g.route(db); err != nil {
+			t.Fatalf("%s: %s", tc.desc, err)
+		}
+		if rr.Code != tc.want {
+			t.Errorf("%s: %s %s = HTTP %d, want %d", tc.desc, tc.method, tc.path, rr.Code, tc.want)
+		}
+	}
+}
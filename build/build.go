@@ -12,4 +12,7 @@ var (
 	DefaultLoopbackInterface string = "lo1"
 	DefaultRemote            string = ""
 	DefaultAddLinkUrl        string = ""
+	DefaultEdit              string = "false"
+	DefaultStore             string = "json"
+	DefaultSync              string = "mirror"
 )
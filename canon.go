@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// canonPolicy decides which link names are the same link.
+type canonPolicy struct {
+	Strip         string // Characters removed from names
+	StripPunct    bool   // Remove all Unicode punctuation
+	StripSpace    bool   // Remove all Unicode white space
+	CaseSensitive bool
+	NFKC          bool // Apply Unicode NFKC normalization first, so e.g. fullwidth letters match ASCII
+}
+
+// linkCanon is the policy used by canonicalizeLink, set from the --canon-* flags.
+var linkCanon = canonPolicy{Strip: ".-_"}
+
+// newCanonPolicy parses --canon-strip, where the classes [:punct:] and [:space:] may be given
+// along with literal characters.
+func newCanonPolicy(strip string, caseSensitive bool, nfkc bool) (canonPolicy, error) {
+	p := canonPolicy{CaseSensitive: caseSensitive, NFKC: nfkc}
+	if strings.Contains(strip, "[:punct:]") {
+		p.StripPunct = true
+		strip = strings.ReplaceAll(strip, "[:punct:]", "")
+	}
+	if strings.Contains(strip, "[:space:]") {
+		p.StripSpace = true
+		strip = strings.ReplaceAll(strip, "[:space:]", "")
+	}
+	if strings.ContainsRune(strip, '/') {
+		// Removing slashes would merge nested links like jira/new with jiranew and break prefix lookups
+		return p, fmt.Errorf("Invalid --canon-strip '%s'; '/' separates the parts of a link and can't be removed", strip)
+	}
+	p.Strip = strip
+	return p, nil
+}
+
+// Canonicalize returns the name a link is stored and looked up by. Slashes are always kept.
+func (p canonPolicy) Canonicalize(l string) string {
+	if p.NFKC {
+		l = norm.NFKC.String(l)
+	}
+	if !p.CaseSensitive {
+		l = strings.ToLower(l)
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' {
+			return r
+		}
+		if strings.ContainsRune(p.Strip, r) || p.StripPunct && unicode.IsPunct(r) || p.StripSpace && unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, l)
+}
+
+// canonCollisions returns the names (and aliases) of different links that canonicalize to the
+// same name, by that name.
+func canonCollisions(links []Link) map[string][]string {
+	names := map[string][]string{}
+	owners := map[string]map[int]bool{}
+	for i, l := range links {
+		for _, n := range l.Names() {
+			c := canonicalizeLink(n)
+			if owners[c] == nil {
+				owners[c] = map[int]bool{}
+			}
+			owners[c][i] = true
+			names[c] = append(names[c], n)
+		}
+	}
+	maps.DeleteFunc(names, func(c string, _ []string) bool { return len(owners[c]) < 2 })
+	return names
+}
+
+// reportCanonCollisions logs the links that are merged by the canonicalization policy.
+func reportCanonCollisions(links []Link) {
+	collisions := canonCollisions(links)
+	if len(collisions) == 0 {
+		return
+	}
+	log.Printf("%d link names collide under the canonicalization policy (--canon-*); only one link is kept for each:\n", len(collisions))
+	for _, c := range slices.Sorted(maps.Keys(collisions)) {
+		log.Printf("\t%s: %s\n", c, strings.Join(collisions[c], ", "))
+	}
+}
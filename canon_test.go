@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCanonPolicy(t *testing.T) {
+	tests := []struct {
+		strip         string
+		caseSensitive bool
+		nfkc          bool
+		name          string
+		want          string
+	}{
+		{".-_", false, false, "Foo-Bar.Baz_1", "foobarbaz1"},
+		{".-_", false, false, "team/Foo-Bar", "team/foobar"},
+		{".-_", true, false, "Foo-Bar", "FooBar"},
+		{"", false, false, "Foo-Bar", "foo-bar"},
+		{"[:punct:]", false, false, "foo!bar/a+b", "foobar/a+b"},
+		{"[:punct:][:space:]", false, false, "foo bar,baz", "foobarbaz"},
+		{".-_", false, false, "ｆｏｏ－ｂａｒ", "ｆｏｏ－ｂａｒ"},
+		{".-_", false, true, "ｆｏｏ－ｂａｒ", "foobar"},
+		{".-_", false, true, "ﬁle", "file"},
+	}
+	for _, tc := range tests {
+		p, err := newCanonPolicy(tc.strip, tc.caseSensitive, tc.nfkc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Canonicalize(tc.name); got != tc.want {
+			t.Errorf("newCanonPolicy(%q, %v, %v).Canonicalize(%q) = %q, want %q", tc.strip, tc.caseSensitive, tc.nfkc, tc.name, got, tc.want)
+		}
+	}
+	if _, err := newCanonPolicy("/", false, false); err == nil {
+		t.Errorf("newCanonPolicy(%q) succeeded, want an error", "/")
+	}
+}
+
+func TestCanonCollisions(t *testing.T) {
+	links := []Link{
+		{Display: "foo-bar"},
+		{Display: "FooBar"},
+		{Display: "wiki", Aliases: []string{"docs"}},
+		{Display: "D.O.C.S"},
+		{Display: "other"},
+	}
+	got := canonCollisions(links)
+	if len(got) != 2 || len(got["foobar"]) != 2 || len(got["docs"]) != 2 {
+		t.Errorf("canonCollisions() = %q, want foobar and docs", got)
+	}
+}
+
+func TestLoadRecanonicalizes(t *testing.T) {
+	defer func(p canonPolicy) { linkCanon = p }(linkCanon)
+
+	store, err := newLinkStore("sqlite", filepath.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	db := &LinkDB{Store: store}
+	l, _ := db.Put(Link{Display: "Foo-Bar", Destination: "http://example.org"})
+	if err := db.Save([]Link{l}, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.RecordClick(l.Source, time.Now())
+	if err := db.SaveClicks(); err != nil {
+		t.Fatal(err)
+	}
+
+	linkCanon = canonPolicy{CaseSensitive: true}
+	db = &LinkDB{Store: store}
+	db.setHealth(l.Source, linkHealth{Destination: l.Destination, Broken: true})
+	if err := db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	// The usage moves with the link
+	if err := db.SaveClicks(); err != nil {
+		t.Fatal(err)
+	}
+	if h := db.Health("Foo-Bar"); h == nil || !h.Broken {
+		t.Errorf("Health(Foo-Bar) = %+v after changing the policy, want the check of %s", h, l.Source)
+	}
+	db = &LinkDB{Store: store}
+	if err := db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if c := db.Clicks("Foo-Bar"); c.Total != 1 {
+		t.Errorf("Clicks(Foo-Bar) = %+v after changing the policy, want the click recorded as %s", c, l.Source)
+	}
+	if l := db.Lookup("Foo-Bar"); l == nil || l.Source != "Foo-Bar" {
+		t.Errorf("Lookup(Foo-Bar) = %+v after changing the policy, want Source Foo-Bar", l)
+	}
+	stored, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].Source != "Foo-Bar" {
+		t.Errorf("store.Load() = %+v, want only the link under its new name", stored)
+	}
+}
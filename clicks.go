@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"time"
+)
+
+// clickDays is how many days of daily click counts are kept, which bounds the rolling counts.
+const clickDays = 30
+
+// clickSaveInterval is how often click counts are written to the store.
+const clickSaveInterval = time.Minute
+
+const dayFormat = "2006-01-02"
+
+// ClickStats counts how often a link has been followed.
+type ClickStats struct {
+	Total    uint64
+	LastUsed time.Time
+	Daily    map[string]uint64 `json:",omitempty"` // By UTC day (2006-01-02), for the last clickDays days
+}
+
+// Since returns the number of clicks in the last days days, including today.
+func (c ClickStats) Since(now time.Time, days int) uint64 {
+	var n uint64
+	day := now.UTC()
+	for i := 0; i < days; i++ {
+		n += c.Daily[day.Format(dayFormat)]
+		day = day.AddDate(0, 0, -1)
+	}
+	return n
+}
+
+// record counts a click at now, forgetting days older than clickDays.
+func (c ClickStats) record(now time.Time) ClickStats {
+	daily := map[string]uint64{}
+	oldest := now.UTC().AddDate(0, 0, -clickDays+1).Format(dayFormat)
+	for d, n := range c.Daily {
+		if d >= oldest {
+			daily[d] = n
+		}
+	}
+	daily[now.UTC().Format(dayFormat)]++
+	return ClickStats{c.Total + 1, now, daily}
+}
+
+// RecordClick counts a use of the link with the given source.
+func (db *LinkDB) RecordClick(source string, now time.Time) {
+	db.clicksMu.Lock()
+	defer db.clicksMu.Unlock()
+	if db.clicks == nil {
+		db.clicks = map[string]ClickStats{}
+		db.clicksDirty = map[string]bool{}
+	}
+	db.clicks[source] = db.clicks[source].record(now)
+	db.clicksDirty[source] = true
+}
+
+// Clicks returns the click counts of the link with the given source.
+func (db *LinkDB) Clicks(source string) ClickStats {
+	db.clicksMu.Lock()
+	defer db.clicksMu.Unlock()
+	return db.clicks[source]
+}
+
+// AllClicks returns the click counts of every link that has been used, by source.
+func (db *LinkDB) AllClicks() map[string]ClickStats {
+	db.clicksMu.Lock()
+	defer db.clicksMu.Unlock()
+	return maps.Clone(db.clicks)
+}
+
+// loadClicks reads the click counts from the store.
+func (db *LinkDB) loadClicks() error {
+	clicks, err := db.Store.LoadClicks()
+	if err != nil {
+		return err
+	}
+	db.clicksMu.Lock()
+	defer db.clicksMu.Unlock()
+	db.clicks = clicks
+	if db.clicks == nil {
+		db.clicks = map[string]ClickStats{}
+	}
+	db.clicksDirty = map[string]bool{}
+	return nil
+}
+
+// SaveClicks writes click counts that changed since the last save to the store.
+// Counts of links that no longer exist are dropped.
+func (db *LinkDB) SaveClicks() error {
+	if db.Store == nil {
+		return nil
+	}
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+	if db.frozen {
+		return nil
+	}
+
+	db.mu.RLock()
+	exists := map[string]bool{}
+	for src := range db.links {
+		exists[src] = true
+	}
+	db.mu.RUnlock()
+
+	db.clicksMu.Lock()
+	changed := []string{}
+	for src := range db.clicksDirty {
+		if exists[src] {
+			changed = append(changed, src)
+		}
+	}
+	dropped := 0
+	for src := range db.clicks {
+		if !exists[src] {
+			delete(db.clicks, src)
+			dropped++
+		}
+	}
+	if len(changed) == 0 && dropped == 0 {
+		db.clicksMu.Unlock()
+		return nil
+	}
+	all := maps.Clone(db.clicks)
+	dirty := db.clicksDirty
+	db.clicksDirty = map[string]bool{}
+	db.clicksMu.Unlock()
+
+	slices.Sort(changed)
+	err := db.Store.SaveClicks(all, changed)
+	if err != nil {
+		// Try again next time
+		db.clicksMu.Lock()
+		for src := range dirty {
+			db.clicksDirty[src] = true
+		}
+		db.clicksMu.Unlock()
+		metrics.CacheWriteErrs.Add("", 1)
+	}
+	return err
+}
+
+// saveClicksEvery saves click counts every interval until ctx is done, and once more after.
+func (db *LinkDB) saveClicksEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := db.SaveClicks(); err != nil {
+				log.Printf("Could not save click counts: %s\n", err)
+			}
+			return
+		}
+		if err := db.SaveClicks(); err != nil {
+			log.Printf("Could not save click counts: %s\n", err)
+		}
+	}
+}
+
+// linkClicks is a link with its click counts, as shown by /_/view and /_/api/clicks.
+type linkClicks struct {
+	Link
+	Clicks     uint64
+	LastUsed   time.Time
+	Last7Days  uint64
+	Last30Days uint64
+}
+
+// clickSorts orders linkClicks by the key given as the sort parameter; the default is by name.
+var clickSorts = map[string]func(a, b linkClicks) int{
+	"clicks": func(a, b linkClicks) int { return -cmpUint(a.Clicks, b.Clicks) },
+	"7d":     func(a, b linkClicks) int { return -cmpUint(a.Last7Days, b.Last7Days) },
+	"30d":    func(a, b linkClicks) int { return -cmpUint(a.Last30Days, b.Last30Days) },
+	"last":   func(a, b linkClicks) int { return b.LastUsed.Compare(a.LastUsed) },
+}
+
+func cmpUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// allLinkClicks returns every link with its click counts, sorted by the named key.
+func (db *LinkDB) allLinkClicks(now time.Time, sortBy string) []linkClicks {
+	clicks := db.AllClicks()
+	lcs := []linkClicks{}
+	for _, l := range db.All() {
+		c := clicks[l.Source]
+		lcs = append(lcs, linkClicks{l, c.Total, c.LastUsed, c.Since(now, 7), c.Since(now, 30)})
+	}
+	if cmp, ok := clickSorts[sortBy]; ok {
+		slices.SortStableFunc(lcs, cmp)
+	}
+	return lcs
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClickStats(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	c := ClickStats{}
+	for _, ago := range []int{40, 29, 10, 6, 0, 0} {
+		c = c.record(now.AddDate(0, 0, -ago))
+	}
+	if c.Total != 6 {
+		t.Errorf("Total = %d, want 6", c.Total)
+	}
+	if !c.LastUsed.Equal(now) {
+		t.Errorf("LastUsed = %s, want %s", c.LastUsed, now)
+	}
+	if _, ok := c.Daily["2024-02-20"]; ok {
+		t.Errorf("Daily = %v, want days older than %d forgotten", c.Daily, clickDays)
+	}
+	for _, tc := range []struct {
+		days int
+		want uint64
+	}{{1, 2}, {7, 3}, {30, 5}} {
+		if got := c.Since(now, tc.days); got != tc.want {
+			t.Errorf("Since(%d) = %d, want %d", tc.days, got, tc.want)
+		}
+	}
+}
+
+func TestFuzzyLookupPopularity(t *testing.T) {
+	db := &LinkDB{}
+	db.Update([]Link{
+		{Display: "docs", Destination: "http://docs"},
+		{Display: "docs-old", Destination: "http://docs-old"},
+		{Display: "dogs", Destination: "http://dogs"},
+	})
+	for i := 0; i < 3; i++ {
+		db.RecordClick("docsold", time.Now())
+	}
+	got := db.FuzzyLookup("doc")
+	if len(got) != 2 || got[0].Source != "docsold" || got[1].Source != "docs" {
+		names := []string{}
+		for _, l := range got {
+			names = append(names, l.Source)
+		}
+		t.Errorf("FuzzyLookup(%q) = %v, want [docsold docs]", "doc", names)
+	}
+}
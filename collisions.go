@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// collisionPolicies choose which of two different links with the same canonicalized name is kept,
+// returning a negative number if a should be kept over b. Ties are broken by name and destination
+// so the same link always wins whatever order the links are in.
+var collisionPolicies = map[string]func(a, b Link) int{
+	"newest": func(a, b Link) int { return b.Updated.Compare(a.Updated) },
+	"oldest": func(a, b Link) int {
+		// Links without a creation time, e.g. from an older cache, lose
+		if a.Created.IsZero() != b.Created.IsZero() {
+			if a.Created.IsZero() {
+				return 1
+			}
+			return -1
+		}
+		return a.Created.Compare(b.Created)
+	},
+	"name": func(a, b Link) int { return 0 },
+}
+
+const defaultCollisionPolicy = "newest"
+
+// linkCollision records different links whose names canonicalize to the same Source.
+type linkCollision struct {
+	Source string
+	Winner Link
+	Losers []Link
+	Reason string // Why the winner was kept: the collision policy, "priority" or "local"
+	Where  string // "cache", or the name of the remote source with the links
+	Time   time.Time
+}
+
+func (c linkCollision) String() string {
+	losers := []string{}
+	for _, l := range c.Losers {
+		losers = append(losers, l.Display)
+	}
+	return fmt.Sprintf("%s in %s: kept %s over %s (%s)", c.Source, c.Where, c.Winner.Display, strings.Join(losers, ", "), c.Reason)
+}
+
+// collisionPolicy returns the name of the policy used by the db.
+func (db *LinkDB) collisionPolicy() string {
+	if db.CollisionPolicy == "" {
+		return defaultCollisionPolicy
+	}
+	return db.CollisionPolicy
+}
+
+// compareLinks orders links with the same Source by the collision policy, the winner first.
+func (db *LinkDB) compareLinks(a, b Link) int {
+	if c := collisionPolicies[db.collisionPolicy()](a, b); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Display, b.Display); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Destination, b.Destination)
+}
+
+// resolveCollisions keeps one link for each Source among links, which must have their Source set.
+// Entries with the same display name are the same link, and the last one is kept. Of different
+// links the winner under the collision policy is kept, and the collision is returned.
+func (db *LinkDB) resolveCollisions(links []Link, where string) ([]Link, []linkCollision) {
+	order := []string{}
+	groups := map[string][]Link{}
+	for _, l := range links {
+		g, ok := groups[l.Source]
+		if !ok {
+			order = append(order, l.Source)
+		}
+		if i := slices.IndexFunc(g, func(o Link) bool { return o.Display == l.Display }); i >= 0 {
+			g[i] = l
+		} else {
+			g = append(g, l)
+		}
+		groups[l.Source] = g
+	}
+	ret := make([]Link, 0, len(order))
+	collisions := []linkCollision{}
+	for _, src := range order {
+		g := groups[src]
+		if len(g) > 1 {
+			slices.SortFunc(g, db.compareLinks)
+			collisions = append(collisions, linkCollision{src, g[0], g[1:], db.collisionPolicy(), where, time.Now()})
+		}
+		ret = append(ret, g[0])
+	}
+	return ret, collisions
+}
+
+// setCollisions replaces the collisions found by the named step, "cache" or "sync", logging them.
+func (db *LinkDB) setCollisions(step string, collisions []linkCollision) {
+	for _, c := range collisions {
+		log.Printf("Link name collision: %s\n", c)
+	}
+	db.collisionsMu.Lock()
+	defer db.collisionsMu.Unlock()
+	if db.collisions == nil {
+		db.collisions = map[string][]linkCollision{}
+	}
+	db.collisions[step] = collisions
+}
+
+// Collisions returns every known collision ordered by Source.
+func (db *LinkDB) Collisions() []linkCollision {
+	db.collisionsMu.Lock()
+	defer db.collisionsMu.Unlock()
+	all := []linkCollision{}
+	for _, step := range slices.Sorted(maps.Keys(db.collisions)) {
+		all = append(all, db.collisions[step]...)
+	}
+	slices.SortStableFunc(all, func(a, b linkCollision) int { return strings.Compare(a.Source, b.Source) })
+	return all
+}
+
+func (g *goHttp) handleCollisions(db *LinkDB) error {
+	data := struct {
+		Collisions []linkCollision
+		Policy     string
+		Prefix     string
+	}{db.Collisions(), db.collisionPolicy(), g.R.Host}
+	return executeTmpl(g.W, http.StatusOK, " - Collisions", "collisions.tmpl", data)
+}
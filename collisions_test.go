@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestResolveCollisions(t *testing.T) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	links := []Link{
+		{Source: "foobar", Display: "Foo-Bar", Destination: "http://a", Created: older, Updated: older},
+		{Source: "foobar", Display: "foobar", Destination: "http://b", Created: newer, Updated: newer},
+		{Source: "foobar", Display: "foo.bar", Destination: "http://c"},
+		{Source: "wiki", Display: "wiki", Destination: "http://old"},
+		{Source: "wiki", Display: "wiki", Destination: "http://new"},
+	}
+	reversed := slices.Clone(links)
+	slices.Reverse(reversed)
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{"newest", "http://b"},
+		{"oldest", "http://a"},
+		{"name", "http://a"},
+	}
+	for _, tc := range tests {
+		db := &LinkDB{CollisionPolicy: tc.policy}
+		// The winner doesn't depend on the order of the links
+		for _, ls := range [][]Link{links, reversed} {
+			got, collisions := db.resolveCollisions(ls, "cache")
+			i := slices.IndexFunc(got, func(l Link) bool { return l.Source == "foobar" })
+			if len(got) != 2 || got[i].Destination != tc.want {
+				t.Errorf("%s: resolveCollisions() = %+v, want foobar -> %s", tc.policy, got, tc.want)
+			}
+			if len(collisions) != 1 || collisions[0].Source != "foobar" || len(collisions[0].Losers) != 2 || collisions[0].Reason != tc.policy {
+				t.Errorf("%s: collisions = %+v, want one for foobar", tc.policy, collisions)
+			}
+		}
+	}
+	if got, _ := (&LinkDB{}).resolveCollisions(links, "cache"); got[1].Destination != "http://new" {
+		t.Errorf("resolveCollisions() kept %s for a duplicate link, want the last one", got[1].Destination)
+	}
+}
+
+func TestSyncCollisions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			w.Write([]byte(`[{"Display": "Foo-Bar", "Destination": "http://a/1"}, {"Display": "foobar", "Destination": "http://a/2"}, {"Display": "my-link", "Destination": "http://a/3"}]`))
+		case "/b":
+			w.Write([]byte(`[{"Display": "foo.bar", "Destination": "http://b/1"}]`))
+		}
+	}))
+	defer srv.Close()
+
+	db := &LinkDB{CollisionPolicy: "name"}
+	db.Put(Link{Display: "MyLink", Destination: "http://mine", Origin: originLocal})
+	rs, err := newRemoteSet(db, []*remoteSource{
+		{Name: "a", URL: srv.URL + "/a", Priority: 1},
+		{Name: "b", URL: srv.URL + "/b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range rs.sources {
+		if err := rs.update(context.Background(), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l := db.Lookup("foobar"); l == nil || l.Destination != "http://a/1" {
+		t.Errorf("Lookup(foobar) = %+v, want Foo-Bar from a", l)
+	}
+	got := []string{}
+	for _, c := range db.Collisions() {
+		got = append(got, c.Source+" "+c.Where+" "+c.Reason)
+	}
+	want := []string{"foobar a name", "foobar b priority", "mylink a local"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Collisions() = %q, want %q", got, want)
+	}
+
+	req := httptest.NewRequest("GET", "/_/collisions", nil)
+	rr := httptest.NewRecorder()
+	g := goHttp{W: rr, R: req}
+	if err := g.handleCollisions(db); err != nil || rr.Code != http.StatusOK {
+		t.Errorf("GET /_/collisions = HTTP %d, %v", rr.Code, err)
+	}
+}
@@ -2,17 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"maps"
-	"net/http"
-	"os"
 	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/google/renameio/v2"
 	"github.com/lithammer/fuzzysearch/fuzzy"
 )
 
@@ -22,118 +22,395 @@ func readLinks(rdr io.Reader) ([]Link, error) {
 	return links, err
 }
 
-func updateLinksFromRemote(db *LinkDB, path string, cachePath string) error {
-	log.Printf("Updating golinks from %s\n", path)
-	r, err := http.Get(path)
-	if err != nil {
-		return fmt.Errorf("Could not download updated golinks: %w", err)
-	}
-	defer r.Body.Close()
-	l, err := readLinks(r.Body)
-	if err != nil {
-		return fmt.Errorf("Could not parse updated golinks: %w", err)
-	}
-	stat := db.Update(l)
-	log.Printf("Merged %d updated (%d new) golinks\n", len(l), len(stat.Added))
-	if len(stat.Added) > 0 {
-		added := []string{}
-		n := min(5, len(stat.Added))
-		for _, l := range stat.Added[:n] {
-			added = append(added, l.Display)
-		}
-		log.Printf("Sample (up to 5) of new links: %s\n", added)
-		err = db.WriteCache(cachePath)
-		if err != nil {
-			log.Printf("Could not write to cache: %s", err)
-		}
-	}
-	return nil
-}
-
+// LinkDB holds the known links. It is safe for concurrent use: lookups may run
+// while links are updated from the remote or edited through the API.
 type LinkDB struct {
-	once  sync.Once
-	links map[string]Link
+	Store           LinkStore
+	CollisionPolicy string // The name of one of collisionPolicies; empty for the default
+
+	mu      sync.RWMutex
+	links   map[string]Link
+	aliases map[string]string // Canonicalized alias to the Source of its link
+
+	saveMu sync.Mutex // Serializes writes to Store so an older snapshot can't overwrite a newer one
+	frozen bool       // Set once Store belongs to a new process; guarded by saveMu
+
+	clicksMu    sync.Mutex // Separate from mu so following a link doesn't block lookups
+	clicks      map[string]ClickStats
+	clicksDirty map[string]bool // Sources whose clicks changed since the last SaveClicks
+
+	healthMu sync.Mutex
+	health   map[string]linkHealth // By Source, from the linkChecker
+
+	collisionsMu sync.Mutex
+	collisions   map[string][]linkCollision // By the step that found them
 }
 
 type LinkStat struct {
-	Added []Link
+	Added      []Link
+	Changed    []Link // The new version of links whose contents changed
+	Removed    []Link
+	Collisions []linkCollision
 }
 
 func (db *LinkDB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return len(db.links)
 }
 
-func (db *LinkDB) maybeInit() {
-	db.once.Do(func() {
+// maybeInitLocked must be called with mu held for writing.
+func (db *LinkDB) maybeInitLocked() {
+	if db.links == nil {
 		db.links = map[string]Link{}
-	})
+	}
+}
+
+// reindexLocked rebuilds the alias index after links change. It must be called with mu held for writing.
+// If several links have the same alias the one with the first Source wins.
+func (db *LinkDB) reindexLocked() {
+	db.aliases = map[string]string{}
+	for _, src := range slices.Sorted(maps.Keys(db.links)) {
+		for _, a := range db.links[src].Aliases {
+			ca := canonicalizeLink(a)
+			if _, ok := db.aliases[ca]; !ok && ca != "" {
+				db.aliases[ca] = src
+			}
+		}
+	}
 }
 
+// Update adds or replaces links, e.g. from the cache. Of different links with the same canonicalized
+// name only the winner under the collision policy is kept.
 func (db *LinkDB) Update(links []Link) LinkStat {
-	db.maybeInit()
-	stat := LinkStat{[]Link{}}
+	links = slices.Clone(links)
+	for i := range links {
+		maybeFixLinkSource(&links[i])
+	}
+	links, collisions := db.resolveCollisions(links, "cache")
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.maybeInitLocked()
+	stat := LinkStat{Added: []Link{}, Collisions: collisions}
 	for _, link := range links {
-		maybeFixLinkSource(&link)
 		if _, ok := db.links[link.Source]; !ok {
 			stat.Added = append(stat.Added, link)
 		}
 		db.links[link.Source] = link
 	}
+	db.reindexLocked()
 	return stat
 }
 
-func (db *LinkDB) LoadJson(path string) error {
-	f, err := os.Open(path)
-	if os.IsNotExist(err) {
-		log.Printf("Loaded 0 golinks from %s: %s\n", path, err.Error())
-		return nil
+// originInfo describes the remote source a link came from, for resolving conflicts in Sync.
+type originInfo struct {
+	Priority   int
+	Configured bool // The source is still configured
+	Fetched    bool // The source has been downloaded since startup, so its links are known
+}
+
+// Sync merges the combined snapshot of all remote sources into the db, returning the differences.
+// Each link's Origin must be set to the name of its source; origins describes each source.
+//
+// Links created locally are never overwritten. Links without an origin (e.g. from an older cache)
+// are adopted by the source that contains them. A link from a source that hasn't been fetched yet
+// is kept over a link from a lower priority source. If mirror is set, links from fetched sources
+// which are no longer in the snapshot, and links from sources no longer configured, are removed.
+//
+// Links without timestamps are given the time they were first and last synced with different contents.
+// Links with a different name that are kept over a synced link are returned as collisions.
+func (db *LinkDB) Sync(links []Link, origins func(origin string) originInfo, mirror bool) LinkStat {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.maybeInitLocked()
+	defer db.reindexLocked()
+	now := time.Now()
+	stat := LinkStat{[]Link{}, []Link{}, []Link{}, []linkCollision{}}
+	seen := map[string]bool{}
+	for _, link := range links {
+		maybeFixLinkSource(&link)
+		seen[link.Source] = true
+		existing, ok := db.links[link.Source]
+		if ok && existing.Origin != link.Origin && existing.Origin != "" {
+			reason := ""
+			if existing.Origin == originLocal {
+				reason = "local"
+			} else if eo := origins(existing.Origin); eo.Configured && !eo.Fetched && eo.Priority > origins(link.Origin).Priority {
+				reason = "priority"
+			}
+			if reason != "" {
+				if existing.Display != link.Display {
+					stat.Collisions = append(stat.Collisions, linkCollision{link.Source, existing, []Link{link}, reason, link.Origin, now})
+				}
+				continue
+			}
+		}
+		if link.Created.IsZero() {
+			link.Created = now
+			if ok {
+				link.Created = existing.Created
+			}
+		}
+		setUpdated := link.Updated.IsZero()
+		if setUpdated && ok {
+			link.Updated = existing.Updated
+		}
+		switch {
+		case !ok:
+			stat.Added = append(stat.Added, link)
+		case !existing.Equal(link):
+			stat.Changed = append(stat.Changed, link)
+		default:
+			continue
+		}
+		if setUpdated {
+			link.Updated = now
+		}
+		db.links[link.Source] = link
 	}
-	if err != nil {
-		return err
+	if mirror {
+		for src, l := range db.links {
+			if l.Origin == originLocal || l.Origin == "" || seen[src] {
+				continue
+			}
+			if o := origins(l.Origin); !o.Configured || o.Fetched {
+				stat.Removed = append(stat.Removed, l)
+				delete(db.links, src)
+			}
+		}
+		slices.SortFunc(stat.Removed, func(a, b Link) int { return strings.Compare(a.Source, b.Source) })
+	}
+	return stat
+}
+
+// Put adds or replaces a single link, setting its Updated time, and its Created time if it is new and
+// doesn't have one. It returns the stored link and whether it was newly added.
+func (db *LinkDB) Put(link Link) (Link, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.putLocked(link)
+}
+
+// putLocked must be called with mu held.
+func (db *LinkDB) putLocked(link Link) (Link, bool) {
+	db.maybeInitLocked()
+	link.Source = canonicalizeLink(link.Display)
+	existing, exists := db.links[link.Source]
+	link.Updated = time.Now()
+	if exists {
+		link.Created = existing.Created
+	} else if link.Created.IsZero() {
+		link.Created = link.Updated
+	}
+	db.links[link.Source] = link
+	db.reindexLocked()
+	return link, !exists
+}
+
+// Delete removes the link with the given name or alias, returning the removed link if there was one.
+func (db *LinkDB) Delete(name string) (Link, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	l := db.lookupLocked(name)
+	if l == nil {
+		return Link{}, false
+	}
+	delete(db.links, l.Source)
+	db.reindexLocked()
+	return *l, true
+}
+
+// Edit stores l in place of the link named original, or as a new link if original is empty or
+// doesn't exist. It fails if a name or alias of l belongs to another link. If l renames the link,
+// the old one is removed and its Created time, clicks and health carry over. It returns the stored
+// link, the sources of removed links and whether the link is new.
+func (db *LinkDB) Edit(original string, l Link) (Link, []string, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkNamesLocked(l, original); err != nil {
+		return Link{}, nil, false, err
+	}
+	removed := []string{}
+	old := db.lookupLocked(original)
+	if old != nil && old.Source != canonicalizeLink(l.Display) {
+		delete(db.links, old.Source)
+		removed = append(removed, old.Source)
+		l.Created = old.Created
+	}
+	l, added := db.putLocked(l)
+	if len(removed) > 0 {
+		db.moveStats(map[string]string{old.Source: l.Source})
+	}
+	return l, removed, added && old == nil, nil
+}
+
+// checkNamesLocked returns an error if the name or an alias of l belongs to a link other than the one
+// named original. It must be called with mu held for reading.
+func (db *LinkDB) checkNamesLocked(l Link, original string) error {
+	self := db.lookupLocked(original)
+	for _, n := range l.Names() {
+		if other := db.lookupLocked(n); other != nil && (self == nil || other.Source != self.Source) {
+			return fmt.Errorf("Link %s already exists", n)
+		}
+	}
+	return nil
+}
+
+// All returns a copy of every link, ordered by canonicalized name.
+func (db *LinkDB) All() []Link {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	keys := slices.Sorted(maps.Keys(db.links))
+	lns := make([]Link, 0, len(keys))
+	for _, k := range keys {
+		lns = append(lns, db.links[k])
 	}
-	defer f.Close()
-	ls, err := readLinks(f)
+	return lns
+}
+
+// Load reads every link from the store into the db. Links stored under a name that doesn't match
+// the canonicalization policy, e.g. after it was changed, are rewritten under the new name.
+func (db *LinkDB) Load() error {
+	ls, err := db.Store.Load()
 	if err != nil {
 		return err
 	}
+	reportCanonCollisions(ls)
+	oldSources := map[int]string{}
+	for i := range ls {
+		if old := ls[i].Source; maybeFixLinkSource(&ls[i]) {
+			oldSources[i] = old
+		}
+	}
 	stat := db.Update(ls)
-	log.Printf("Loaded %d (%d new) golinks from %s\n", len(ls), len(stat.Added), path)
+	log.Printf("Loaded %d (%d new) golinks from %s\n", len(ls), len(stat.Added), db.Store)
+	db.setCollisions("cache", stat.Collisions)
+
+	renamed, removed := []Link{}, []string{}
+	moved := map[string]string{} // New sources by old
+	db.mu.RLock()
+	for i, old := range oldSources {
+		// Leave links that lost a collision where they are, and don't remove a link that now has the old name
+		if db.links[ls[i].Source].Display != ls[i].Display {
+			continue
+		}
+		renamed = append(renamed, ls[i])
+		if _, ok := db.links[old]; !ok {
+			removed = append(removed, old)
+			moved[old] = ls[i].Source
+		}
+	}
+	db.mu.RUnlock()
+	if len(renamed) > 0 {
+		if err := db.Save(renamed, removed); err != nil {
+			return fmt.Errorf("Could not rewrite recanonicalized links: %w", err)
+		}
+	}
+	if err := db.loadClicks(); err != nil {
+		return err
+	}
+	db.moveStats(moved)
 	return nil
 }
 
-func (db *LinkDB) WriteCache(path string) error {
-	lns := make([]Link, 0, len(db.links))
-	for _, l := range db.links {
-		lns = append(lns, l)
+// moveStats moves the clicks and health of links from their old sources to their new ones, so
+// they aren't dropped as those of removed links.
+func (db *LinkDB) moveStats(moved map[string]string) {
+	db.clicksMu.Lock()
+	for old, src := range moved {
+		if c, ok := db.clicks[old]; ok {
+			delete(db.clicks, old)
+			db.clicks[src] = c
+			db.clicksDirty[src] = true
+		}
+	}
+	db.clicksMu.Unlock()
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	for old, src := range moved {
+		if h, ok := db.health[old]; ok {
+			delete(db.health, old)
+			db.health[src] = h
+		}
+	}
+}
+
+// errFrozen is returned when saving links after Freeze.
+var errFrozen = errors.New("Golinks are being handed over to a new process; try again")
+
+// Freeze stops writes to the store, once any in progress is done, e.g. because a new process has
+// loaded the links from it. Saving links fails from then on and clicks are no longer saved.
+func (db *LinkDB) Freeze() {
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+	db.frozen = true
+}
+
+// Save writes changed and removed links to the store.
+func (db *LinkDB) Save(changed []Link, removed []string) error {
+	if db.Store == nil {
+		return nil
+	}
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+	if db.frozen {
+		return errFrozen
 	}
-	b, err := json.Marshal(lns)
+	err := db.Store.Save(db.All(), changed, removed)
 	if err != nil {
-		return err
+		metrics.CacheWriteErrs.Add("", 1)
 	}
-	log.Printf("Writing %d golinks to %s\n", len(db.links), path)
-	return renameio.WriteFile(path, b, 0644)
+	return err
 }
 
 func (db *LinkDB) Lookup(name string) *Link {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.lookupLocked(name)
+}
+
+// lookupLocked must be called with mu held for reading.
+func (db *LinkDB) lookupLocked(name string) *Link {
 	if name == "" {
 		// Special case the empty string - the db has an entry with one :(
 		return nil
 	}
-	l, ok := db.links[canonicalizeLink(name)]
+	src := canonicalizeLink(name)
+	l, ok := db.links[src]
 	if !ok {
-		return nil
+		if l, ok = db.links[db.aliases[src]]; !ok {
+			return nil
+		}
 	}
 	return &l
 }
 
+// PrefixLookup finds the link with the longest name that is a path prefix of name.
+// It returns the link along with the remaining path (without a leading slash).
+func (db *LinkDB) PrefixLookup(name string) (*Link, string) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for i := len(name); i > 0; i = strings.LastIndex(name[:i], "/") {
+		if l := db.lookupLocked(name[:i]); l != nil {
+			return l, strings.TrimPrefix(name[i:], "/")
+		}
+	}
+	return nil, ""
+}
+
+// FuzzyLookup returns the links similar to name, the most used in the last 30 days first.
 func (db *LinkDB) FuzzyLookup(name string) []*Link {
-	l := db.Lookup(name)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	l := db.lookupLocked(name)
 	if l != nil {
 		return []*Link{l}
 	}
 	needle := canonicalizeLink(name)
 	haystack := slices.Collect(maps.Keys(db.links))
+	haystack = append(haystack, slices.Collect(maps.Keys(db.aliases))...)
 	slices.Sort(haystack)
+	haystack = slices.Compact(haystack)
 
 	matches := fuzzy.RankFindNormalized(needle, haystack)
 	sort.Sort(matches)
@@ -145,10 +422,19 @@ func (db *LinkDB) FuzzyLookup(name string) []*Link {
 			// Too dissimilar, and all following ones will be too
 			break
 		}
-		ret = append(ret, db.Lookup(m.Target))
-		if len(ret) > 8 {
-			break
+		l := db.lookupLocked(m.Target)
+		if !slices.ContainsFunc(ret, func(r *Link) bool { return r.Source == l.Source }) {
+			ret = append(ret, l)
 		}
 	}
+	now := time.Now()
+	popularity := map[string]uint64{}
+	for _, l := range ret {
+		popularity[l.Source] = db.Clicks(l.Source).Since(now, 30)
+	}
+	slices.SortStableFunc(ret, func(a, b *Link) int { return -cmpUint(popularity[a.Source], popularity[b.Source]) })
+	if len(ret) > 9 {
+		ret = ret[:9]
+	}
 	return ret
 }
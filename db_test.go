@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLinkDBConcurrentUpdate exercises lookups while links are being updated; run with -race.
+func TestLinkDBConcurrentUpdate(t *testing.T) {
+	db := &LinkDB{Store: &jsonStore{filepath.Join(t.TempDir(), "cache.json")}}
+	db.Update([]Link{{Display: "seed", Destination: "http://seed"}})
+
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	for w := range 2 {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for i := range 100 {
+				name := fmt.Sprintf("link-%d-%d", w, i)
+				db.Update([]Link{{Display: name, Destination: "http://example.org/" + name}})
+				l, _ := db.Put(Link{Display: name + "x", Destination: "http://example.org"})
+				db.Delete(l.Display)
+				if i%25 == 0 {
+					if err := db.Save([]Link{l}, nil); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if db.Lookup("seed") == nil {
+					t.Error("Lookup(seed) = nil during update")
+				}
+				for _, l := range db.FuzzyLookup("seeed") {
+					if l == nil {
+						t.Error("FuzzyLookup returned a nil link")
+					}
+				}
+				db.PrefixLookup("seed/a/b")
+				db.All()
+				db.Len()
+			}
+		}()
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	if got := db.Len(); got != 201 {
+		t.Errorf("Len() = %d, want 201", got)
+	}
+}
+
+func TestLinkDBSync(t *testing.T) {
+	db := &LinkDB{}
+	db.Update([]Link{{Display: "legacy", Destination: "http://legacy"}})
+	db.Put(Link{Display: "mine", Destination: "http://mine", Origin: originLocal})
+
+	src := &remoteSource{Name: originRemote}
+	fetched := func(string) originInfo { return originInfo{0, true, true} }
+	db.Sync(src.applyNamespace([]Link{
+		{Display: "legacy", Destination: "http://legacy"},
+		{Display: "mine", Destination: "http://theirs"},
+		{Display: "old-name", Destination: "http://x"},
+		{Display: "keep", Destination: "http://keep"},
+	}), fetched, true)
+
+	stat := db.Sync(src.applyNamespace([]Link{
+		{Display: "mine", Destination: "http://theirs"},
+		{Display: "new-name", Destination: "http://x"},
+		{Display: "keep", Destination: "http://keep2"},
+	}), fetched, true)
+
+	names := func(ls []Link) []string {
+		ret := []string{}
+		for _, l := range ls {
+			ret = append(ret, l.Display)
+		}
+		return ret
+	}
+	if got, want := names(stat.Added), []string{"new-name"}; !slices.Equal(got, want) {
+		t.Errorf("Added = %v, want %v", got, want)
+	}
+	if got, want := names(stat.Changed), []string{"keep"}; !slices.Equal(got, want) {
+		t.Errorf("Changed = %v, want %v", got, want)
+	}
+	if got, want := names(stat.Removed), []string{"legacy", "old-name"}; !slices.Equal(got, want) {
+		t.Errorf("Removed = %v, want %v", got, want)
+	}
+	if l := db.Lookup("mine"); l == nil || l.Destination != "http://mine" {
+		t.Errorf("Lookup(mine) = %+v, want the local link to be kept", l)
+	}
+
+	if l := db.Lookup("new-name"); l == nil || l.Created.IsZero() || !l.Updated.Equal(l.Created) {
+		t.Errorf("Lookup(new-name) = %+v, want the time it was added", l)
+	}
+	if l := db.Lookup("keep"); l == nil || !l.Updated.After(l.Created) {
+		t.Errorf("Lookup(keep) = %+v, want updated after it was created", l)
+	}
+
+	stat = db.Sync([]Link{}, fetched, false)
+	if len(stat.Removed) != 0 || db.Len() != 3 {
+		t.Errorf("Sync without mirror removed %d links, leaving %d", len(stat.Removed), db.Len())
+	}
+}
+
+func TestLinkDBEdit(t *testing.T) {
+	db := &LinkDB{}
+	old, _, added, err := db.Edit("", Link{Display: "old", Destination: "http://old"})
+	if err != nil || !added {
+		t.Fatalf("Edit() of a new link = %v, added %v", err, added)
+	}
+	db.Put(Link{Display: "taken", Destination: "http://taken"})
+	db.RecordClick(old.Source, time.Now())
+	db.setHealth(old.Source, linkHealth{Destination: "http://old", Broken: true})
+
+	if _, _, _, err := db.Edit("old", Link{Display: "new", Aliases: []string{"taken"}, Destination: "http://old"}); err == nil {
+		t.Errorf("Edit() onto an existing alias succeeded, want an error")
+	}
+	l, removed, added, err := db.Edit("old", Link{Display: "new", Destination: "http://old"})
+	if err != nil || added || !slices.Equal(removed, []string{"old"}) || !l.Created.Equal(old.Created) {
+		t.Fatalf("Edit() renaming old = %+v, %q, %v, %v, want old removed", l, removed, added, err)
+	}
+	if db.Lookup("old") != nil {
+		t.Errorf("Lookup(old) after renaming it != nil")
+	}
+	if c := db.Clicks("new"); c.Total != 1 {
+		t.Errorf("Clicks(new) = %+v, want the click of old", c)
+	}
+	if h := db.Health("new"); h == nil || !h.Broken {
+		t.Errorf("Health(new) = %+v, want the health of old", h)
+	}
+
+	// Only one of several links claiming the same alias at once is stored
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := db.Edit("", Link{Display: fmt.Sprintf("link-%d", i), Aliases: []string{"shared"}, Destination: "http://shared"}); err == nil {
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if stored != 1 || db.Len() != 3 {
+		t.Errorf("Edit() stored %d of 8 links with the same alias, want 1", stored)
+	}
+}
@@ -26,12 +26,14 @@ var (
 var (
 	flagVersion          = flag.Bool("version", false, "Show version and exit")
 	flagCache            = flag.String("cache", build.DefaultCache, "The filename to load cached golinks from")
+	flagStore            = flag.String("store", build.DefaultStore, "The format of --cache: 'json' for a single JSON file or 'sqlite' for an SQLite database")
 	flagConfig           = flag.String("config", build.DefaultConfig, "The filename to load configuration from.\n\nArguments from the command line and environment variables override entries set here.\n\nThe file format is 'flagname value\\n' as specified by\nhttps://pkg.go.dev/github.com/peterbourgon/ff/v4#PlainParser")
 	flagWriteConfig      = flag.Bool("write-config", false, "Write a default config to --config and exit.")
 	flagWriteConfigForce = flag.Bool("write-config-force", false, "Same as --write-config, but overwrite the file if it exists.")
 
 	flagChain          = flag.String("chain", build.DefaultChain, "The remote URL to chain redirect to (if link not found in local cache)")
 	flagRemote         = flag.String("remote", build.DefaultRemote, "The remote URL to update golinks from")
+	flagSync           = flag.String("sync", build.DefaultSync, "How to apply links from remote sources: 'mirror' to also remove links deleted from the remote, or 'merge' to only add and update links")
 	flagUpdateInterval = flag.Duration("interval", func() time.Duration {
 		d, err := time.ParseDuration(build.DefaultInterval)
 		if err != nil {
@@ -39,9 +41,19 @@ var (
 		}
 		return d
 	}(), "The periodic interval for downloading new golinks")
+	flagRemoteAuth    = flag.String("remote-auth", "", "Comma separated authentication options for --remote, as for --source (e.g. bearer-env=GOLINKS_TOKEN)")
+	flagRemoteTimeout = flag.Duration("remote-timeout", 30*time.Second, "The timeout for downloading golinks from --remote")
+	flagRemoteMaxSize = flag.Int64("remote-max-size", 32<<20, "The maximum size in bytes of the golinks downloaded from --remote")
 
 	flagBind = flag.String("bind", build.DefaultBind, "The IP and port to bind to")
 
+	flagTlsCert         = flag.String("tls-cert", "", "The PEM certificate (and chain) to serve HTTPS with on --bind, instead of HTTP. Requires --tls-key")
+	flagTlsKey          = flag.String("tls-key", "", "The PEM private key of --tls-cert")
+	flagTlsAuto         = flag.Bool("tls-auto", false, "Serve HTTPS on --bind with a certificate for --hostname issued by a local CA, created in --tls-dir.\n\nAdd the CA to your browser or system trust store to trust it.")
+	flagTlsDir          = flag.String("tls-dir", "~/.config/gohome/tls", "The directory keeping the local CA and certificate for --tls-auto")
+	flagShutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for running requests to finish when shutting down, or when handing off to a new process on SIGHUP")
+	flagRedirectBind    = flag.String("redirect-bind", "", "The IP and port to serve plain HTTP on, redirecting to HTTPS on --bind (e.g. 127.0.0.53:80)")
+
 	flagAuto = flag.Bool("auto", func() bool {
 		b, err := strconv.ParseBool(build.DefaultAuto)
 		if err != nil {
@@ -51,10 +63,55 @@ var (
 	}(), "Automatically alias the bind IP address to the loopback interface")
 	flagHostname = flag.String("hostname", build.DefaultHostname, "The hostname to add to /etc/hosts for --auto mode (resolvable to the bind address)")
 
+	flagUser         = flag.String("user", "", "The user to switch to after binding, when started as root. Network changes for --auto mode are made by a helper process that stays root")
+	flagHelper       = flag.Bool("helper", false, "Run only the privileged helper making network changes for --auto mode for an unprivileged server, on --helper-socket or the socket on stdin")
+	flagHelperSocket = flag.String("helper-socket", "", "The unix socket of the privileged helper. The server asks the helper on it to make network changes for --auto mode instead of making them itself")
+	flagCleanup      = flag.Bool("cleanup", false, "Undo the network changes for --auto mode left by gohome processes that exited without undoing them, e.g. because they were killed, and exit")
+
+	flagDnsBind          = flag.String("dns-bind", "", "The IP and port to answer DNS queries for --hostname on (e.g. 127.0.0.1:5353), instead of editing /etc/hosts in --auto mode.\n\nPoint a split DNS rule for --hostname in systemd-resolved or dnsmasq at it.")
+	flagDnsUpstream      = flag.String("dns-upstream", "", "The DNS server to forward queries for other names to from --dns-bind. If empty they are refused")
+	flagDnsForwardRemote = flag.Bool("dns-forward-remote", false, "Forward queries from clients that aren't on a loopback address to --dns-upstream too, instead of refusing them")
+
 	flagAddLinkUrl = flag.String("add-link-url", build.DefaultAddLinkUrl, "The url to add a new golink. If set a link will be displayed when a golink is not found.")
+	flagEdit       = flag.Bool("edit", func() bool {
+		b, err := strconv.ParseBool(build.DefaultEdit)
+		if err != nil {
+			panic(err)
+		}
+		return b
+	}(), "Allow golinks to be created, edited and deleted from the web interface and /_/api/links.\n\nChanges are written to --cache.")
+	flagCanonStrip         = flag.String("canon-strip", ".-_", "Characters ignored in link names, so e.g. foo-bar and foobar are the same link. [:punct:] and [:space:] ignore all punctuation or white space")
+	flagCanonCaseSensitive = flag.Bool("canon-case-sensitive", false, "Treat link names that differ only in case as different links")
+	flagCanonNFKC          = flag.Bool("canon-nfkc", false, "Apply Unicode NFKC normalization to link names, so e.g. fullwidth letters match their ASCII forms")
+
+	flagCollisionPolicy = flag.String("collision-policy", defaultCollisionPolicy, "Which link to keep when different links have the same canonicalized name: 'newest' or 'oldest' by modification time, or 'name' for the first by name")
+
+	flagCheckInterval    = flag.Duration("check-interval", 0, "How often to check every golink destination for errors, flagging broken links. 0 disables checking")
+	flagCheckRate        = flag.Float64("check-rate", 2, "The maximum number of requests per second when checking golink destinations. 0 means no limit")
+	flagCheckConcurrency = flag.Int("check-concurrency", 4, "The maximum number of concurrent requests when checking golink destinations")
+	flagCheckTimeout     = flag.Duration("check-timeout", 10*time.Second, "The timeout for each request when checking golink destinations")
+
+	flagAuthorHeader = flag.String("author-header", "", "The request header naming the user who edits a link (e.g. X-Forwarded-User from an authenticating proxy), recorded as its author")
 )
 
+var flagSources sourceFlag
+
 func init() {
+	flag.Var(&flagSources, "source", "An additional remote to download golinks from (repeatable), as comma separated key=value options. Commas in a URL or header value that aren't followed by an option are part of it:\n\n"+
+		"  name=NAME        required; shown as the source of each link\n"+
+		"  url=URL          required; the URL to download golinks from\n"+
+		"  priority=N       links from higher priority sources win when names conflict (default 0)\n"+
+		"  namespace=PREFIX prefix the name of every link, e.g. team/...\n"+
+		"  interval=DUR     overrides --interval for this source\n"+
+		"  format=FORMAT    json, jsonl, csv, yaml or bookmarks (default: detected from the response)\n\n"+
+		"Authentication options; secrets are read from files or the environment, never the configuration:\n\n"+
+		"  bearer-file=PATH, bearer-env=VAR                    send an Authorization: Bearer token\n"+
+		"  basic-user=USER                                     use basic authentication...\n"+
+		"  basic-password-file=PATH, basic-password-env=VAR    ...with this password\n"+
+		"  header=NAME:VALUE                                   send a header (repeatable); ${VAR} in VALUE is expanded from the environment\n"+
+		"  ca=PATH                                             trust the CAs in this PEM bundle\n"+
+		"  cert=PATH, key=PATH                                 present this PEM client certificate\n\n"+
+		"--remote is equivalent to --source name=remote,url=URL")
 	if runtime.GOOS == "linux" {
 		li := flag.Lookup("loopback-interface")
 		li.DefValue = "lo"
@@ -124,7 +181,7 @@ func handleFlags(argv []string) error {
 	}
 
 	_, configMissingErr := os.Stat(*flagConfig)
-	skip := []string{"config", "write-config", "write-config-force", "version"}
+	skip := []string{"config", "write-config", "write-config-force", "version", "cleanup"}
 
 	if *flagWriteConfig || *flagWriteConfigForce {
 		if configMissingErr == nil && !*flagWriteConfigForce {
@@ -167,12 +224,50 @@ func handleFlags(argv []string) error {
 		log.Printf("Config at %s does not exist\n", *flagConfig)
 	}
 
-	cf := flag.Lookup("cache")
-	ep, err := expandPath(cf.Value.String())
+	if !slices.Contains([]string{"mirror", "merge"}, *flagSync) {
+		return fmt.Errorf("Invalid --sync '%s'; expected 'mirror' or 'merge'", *flagSync)
+	}
+
+	if _, ok := collisionPolicies[*flagCollisionPolicy]; !ok {
+		return fmt.Errorf("Invalid --collision-policy '%s'; expected 'newest', 'oldest' or 'name'", *flagCollisionPolicy)
+	}
+
+	// A process taking over on SIGHUP has already switched
+	if *flagUser != "" && !*flagHelper && os.Geteuid() != 0 && handoffPid() == 0 {
+		return fmt.Errorf("--user %s requires starting as root", *flagUser)
+	}
+
+	canon, err := newCanonPolicy(*flagCanonStrip, *flagCanonCaseSensitive, *flagCanonNFKC)
 	if err != nil {
 		return err
 	}
-	cf.Value.Set(ep)
+	linkCanon = canon
+
+	for _, name := range []string{"cache", "tls-cert", "tls-key", "tls-dir", "autoconfig-state"} {
+		f := flag.Lookup(name)
+		ep, err := expandPath(f.Value.String())
+		if err != nil {
+			return err
+		}
+		f.Value.Set(ep)
+	}
+
+	if *flagCheckRate < 0 || *flagCheckRate > 1e9 {
+		return fmt.Errorf("Invalid --check-rate %v; expected between 0 and 1e9", *flagCheckRate)
+	}
+	if *flagCheckConcurrency < 1 {
+		return fmt.Errorf("Invalid --check-concurrency %d; expected at least 1", *flagCheckConcurrency)
+	}
+
+	if (*flagTlsCert == "") != (*flagTlsKey == "") {
+		return fmt.Errorf("Both --tls-cert and --tls-key are required to serve HTTPS")
+	}
+	if *flagTlsCert != "" && *flagTlsAuto {
+		return fmt.Errorf("Only one of --tls-cert and --tls-auto may be set")
+	}
+	if *flagRedirectBind != "" && *flagTlsCert == "" && !*flagTlsAuto {
+		return fmt.Errorf("--redirect-bind requires HTTPS on --bind; set --tls-cert or --tls-auto")
+	}
 
 	log.Printf("Effective configuration:\n")
 	flag.CommandLine.VisitAll(func(f *flag.Flag) {
@@ -1,11 +1,26 @@
 module github.com/ebnull/gohome
 
-go 1.23.0
+go 1.24.0
 
 require (
 	github.com/google/renameio/v2 v2.0.0
 	github.com/lithammer/fuzzysearch v1.1.8
 	github.com/peterbourgon/ff/v3 v3.4.0
+	golang.org/x/net v0.42.0
+	golang.org/x/text v0.27.0
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.38.2
 )
 
-require golang.org/x/text v0.9.0 // indirect
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b // indirect
+	golang.org/x/sys v0.34.0 // indirect
+	modernc.org/libc v1.66.3 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.11.0 // indirect
+)
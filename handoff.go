@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// On SIGHUP gohome starts a new process of its binary, e.g. after an upgrade, and hands its
+// sockets off to it as socket activation would. The new process checks it can serve and tells the
+// old one over the "handoff" socket. The old process stops accepting connections, saves its links
+// and tells the new one, which loads them and serves while the old one finishes its requests and
+// exits. Connections made in between wait in the listen backlog, so none are dropped.
+
+// handoffEnv has the pid of the process handing off to this one.
+const handoffEnv = "GOHOME_HANDOFF_PID"
+
+// handoffTimeout is how long the new process may take to get ready before it is killed.
+const handoffTimeout = time.Minute
+
+// handoffSocket is a socket handed off to the new process.
+type handoffSocket struct {
+	Name string
+	Conn any // A listener or connection with a File method, like *net.TCPListener, or an *os.File to hand off and close
+}
+
+// handoffPid returns the pid of the process handing off to this one, or 0.
+func handoffPid() int {
+	pid, err := strconv.Atoi(os.Getenv(handoffEnv))
+	if err != nil || pid != os.Getppid() {
+		return 0
+	}
+	return pid
+}
+
+// handOff starts the new process with the sockets and waits for it to get ready. Closing the
+// returned socket, e.g. by exiting, lets it take over. If it fails this process keeps serving.
+func handOff(sockets []handoffSocket) (*os.File, error) {
+	files, names := []*os.File{}, []string{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var err error
+	for _, s := range sockets {
+		var f *os.File
+		switch c := s.Conn.(type) {
+		case *os.File:
+			f = c
+		case interface{ File() (*os.File, error) }:
+			f, err = c.File()
+		default:
+			err = fmt.Errorf("Can't hand off %s socket %T", s.Name, s.Conn)
+		}
+		if err != nil {
+			// The remaining files are closed too
+			for _, s := range sockets {
+				if f, ok := s.Conn.(*os.File); ok {
+					f.Close()
+				}
+			}
+			return nil, err
+		}
+		files, names = append(files, f), append(names, s.Name)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	// For the read deadline
+	syscall.SetNonblock(fds[0], true)
+	parent, child := os.NewFile(uintptr(fds[0]), "handoff"), os.NewFile(uintptr(fds[1]), "handoff")
+	files, names = append(files, child), append(names, "handoff")
+
+	exe, err := os.Executable()
+	if err != nil {
+		parent.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// The files become descriptors 3 and up, as with socket activation
+	cmd.ExtraFiles = files
+	for _, e := range os.Environ() {
+		switch name, _, _ := strings.Cut(e, "="); name {
+		// The new process's pid isn't known yet, and is any process for the watchdog
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID", handoffEnv:
+		default:
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("LISTEN_FDS=%d", len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		fmt.Sprintf("%s=%d", handoffEnv, os.Getpid()))
+	log.Printf("Handing off to a new %s\n", exe)
+	if err := cmd.Start(); err != nil {
+		parent.Close()
+		return nil, fmt.Errorf("Could not start a new process: %w", err)
+	}
+	go cmd.Wait()
+
+	parent.SetReadDeadline(time.Now().Add(handoffTimeout))
+	if _, err := io.ReadFull(parent, make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		parent.Close()
+		return nil, fmt.Errorf("The new process (pid %d) didn't get ready: %w", cmd.Process.Pid, err)
+	}
+	log.Printf("Handing off to pid %d\n", cmd.Process.Pid)
+	return parent, nil
+}
+
+// takeOver tells the process handing off to this one on f that it is ready, and waits for it to
+// save its links so they can be loaded.
+func takeOver(f *os.File, pid int) error {
+	notify(fmt.Sprintf("MAINPID=%d", os.Getpid()))
+	if _, err := f.Write([]byte{1}); err != nil {
+		return fmt.Errorf("Could not take over from pid %d: %w", pid, err)
+	}
+	log.Printf("Waiting for pid %d to save its golinks\n", pid)
+	if _, err := io.ReadFull(f, make([]byte, 1)); err != nil {
+		// It exited, so what is stored is all there is
+		log.Printf("Pid %d didn't hand over its golinks: %s\n", pid, err)
+	}
+	return nil
+}
+
+// finishTakeOver waits for the process handing off to this one on f to finish its requests and
+// exit, closing f.
+func finishTakeOver(f *os.File, pid int) {
+	defer f.Close()
+	io.Copy(io.Discard, f)
+	log.Printf("Took over from pid %d\n", pid)
+}
+
+// handOverLinks saves the clicks of db and stops it from writing to its store, then tells the new
+// process on f to load the links. It must be called once nothing else changes the links.
+func handOverLinks(f *os.File, db *LinkDB) error {
+	if err := db.SaveClicks(); err != nil {
+		log.Printf("Could not save click counts: %s\n", err)
+	}
+	db.Freeze()
+	_, err := f.Write([]byte{1})
+	return err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandoffPid(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int
+	}{
+		{"", 0},
+		{strconv.Itoa(os.Getppid()), os.Getppid()},
+		// Only the parent hands off
+		{"1", 0},
+		{"x", 0},
+	}
+	for _, tc := range tests {
+		t.Setenv(handoffEnv, tc.env)
+		if got := handoffPid(); got != tc.want {
+			t.Errorf("handoffPid() with %s=%q = %d, want %d", handoffEnv, tc.env, got, tc.want)
+		}
+	}
+}
+
+func TestConnTracker(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	tr := &connTracker{}
+	now := time.Now()
+	if tr.Busy(now) {
+		t.Errorf("Busy() without connections = true, want false")
+	}
+	tr.ConnState(c1, http.StateNew)
+	if !tr.Busy(time.Now()) {
+		t.Errorf("Busy() with a new connection = false, want true")
+	}
+	if tr.Busy(time.Now().Add(newConnGrace)) {
+		t.Errorf("Busy() with a connection that never sent a request = true, want false")
+	}
+	tr.ConnState(c1, http.StateActive)
+	if !tr.Busy(time.Now().Add(time.Hour)) {
+		t.Errorf("Busy() with an active connection = false, want true")
+	}
+	tr.ConnState(c1, http.StateIdle)
+	tr.ConnState(c2, http.StateNew)
+	tr.ConnState(c2, http.StateClosed)
+	if tr.Busy(time.Now()) {
+		t.Errorf("Busy() with idle and closed connections = true, want false")
+	}
+}
+
+func TestServeUntilDoneFinishesRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serveUntilDone(ctx, &http.Server{Handler: mux}, l) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/slow")
+		if err != nil {
+			got <- result{"", err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		got <- result{string(b), err}
+	}()
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("serveUntilDone() = %v before its request finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// New connections are refused while shutting down
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Errorf("Connected while shutting down")
+	}
+	close(release)
+	if r := <-got; r.err != nil || r.body != "done" {
+		t.Errorf("Request while shutting down = %q, %v, want %q", r.body, r.err, "done")
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("serveUntilDone() = %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestTakeOverChecksFirst(t *testing.T) {
+	if args := os.Getenv("GOHOME_TEST_TAKE_OVER"); args != "" {
+		if err := mainImpl(append([]string{"gohome"}, strings.Fields(args)...)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte("[{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	common := fmt.Sprintf("--config %s --bind 127.0.0.1:0 --edit=false", filepath.Join(dir, "missing.cfg"))
+	tests := []struct {
+		desc string
+		args string
+	}{
+		{"corrupt links", "--auto=false --cache " + corrupt},
+		{"missing loopback interface", "--auto --loopback-interface nonexistent0 --cache " + filepath.Join(dir, "links.json")},
+	}
+	for _, tc := range tests {
+		conn := fakeNotifySocket(t)
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+		syscall.SetNonblock(fds[0], true)
+		parent, child := os.NewFile(uintptr(fds[0]), "handoff"), os.NewFile(uintptr(fds[1]), "handoff")
+		cmd := exec.Command(os.Args[0], "-test.run=^TestTakeOverChecksFirst$")
+		cmd.ExtraFiles = []*os.File{child}
+		cmd.Env = append(os.Environ(), "GOHOME_TEST_TAKE_OVER="+common+" "+tc.args,
+			"LISTEN_FDS=1", "LISTEN_FDNAMES=handoff", fmt.Sprintf("%s=%d", handoffEnv, os.Getpid()))
+		out := &strings.Builder{}
+		cmd.Stderr = out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		child.Close()
+		parent.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, err := parent.Read(make([]byte, 1))
+		parent.Close()
+		if n != 0 {
+			// It got ready and would go on serving
+			cmd.Process.Kill()
+		}
+		cmd.Wait()
+		if n != 0 || err != io.EOF {
+			t.Errorf("%s: new process signalled %d bytes, %v, want it to exit first; output:\n%s", tc.desc, n, err, out)
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, err := conn.Read(make([]byte, 64)); err == nil {
+			t.Errorf("%s: new process notified systemd with %d bytes, want nothing", tc.desc, n)
+		}
+	}
+}
+
+func TestHandOverLinks(t *testing.T) {
+	fakeNotifySocket(t)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, taking := os.NewFile(uintptr(fds[0]), "handoff"), os.NewFile(uintptr(fds[1]), "handoff")
+	db := &LinkDB{Store: &jsonStore{filepath.Join(t.TempDir(), "links.json")}}
+	l, _ := db.Put(Link{Display: "a", Destination: "http://a"})
+	db.RecordClick(l.Source, time.Now())
+
+	tookOver := make(chan error, 1)
+	go func() { tookOver <- takeOver(taking, 1) }()
+	if _, err := io.ReadFull(old, make([]byte, 1)); err != nil {
+		t.Fatalf("No ready byte: %s", err)
+	}
+	select {
+	case err := <-tookOver:
+		t.Fatalf("takeOver() = %v before the links were handed over", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := db.Save([]Link{l}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := handOverLinks(old, db); err != nil {
+		t.Fatalf("handOverLinks() = %v", err)
+	}
+	if err := <-tookOver; err != nil {
+		t.Fatalf("takeOver() = %v", err)
+	}
+
+	// The new process loads what the old one saved, and the old one doesn't write any more
+	loaded := &LinkDB{Store: db.Store}
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Lookup("a") == nil || loaded.Clicks(l.Source).Total != 1 {
+		t.Errorf("Loaded links %+v with clicks %+v, want a with one click", loaded.All(), loaded.AllClicks())
+	}
+	if err := db.Save([]Link{l}, nil); err != errFrozen {
+		t.Errorf("Save() after handing over = %v, want %v", err, errFrozen)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		finishTakeOver(taking, 1)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		t.Fatalf("finishTakeOver() returned while the old process was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	old.Close()
+	<-finished
+}
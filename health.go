@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// linkHealth is the result of checking a link's destination.
+type linkHealth struct {
+	Destination string // The URL that was checked
+	Status      int    // The HTTP status, or 0 if the request failed
+	Error       string `json:",omitempty"`
+	Checked     time.Time
+	Broken      bool
+}
+
+// linkChecker periodically requests the destination of every link to find broken ones.
+type linkChecker struct {
+	DB          *LinkDB
+	Client      *http.Client
+	Interval    time.Duration // Between checks of all links
+	Rate        float64       // Maximum requests per second
+	Concurrency int           // Maximum requests in flight
+}
+
+func newLinkChecker(db *LinkDB, interval time.Duration, rate float64, concurrency int, timeout time.Duration) *linkChecker {
+	return &linkChecker{
+		DB:          db,
+		Client:      &http.Client{Timeout: timeout},
+		Interval:    interval,
+		Rate:        rate,
+		Concurrency: max(concurrency, 1),
+	}
+}
+
+// Run checks every link each Interval until ctx is done.
+func (c *linkChecker) Run(ctx context.Context) {
+	for {
+		c.CheckAll(ctx)
+		select {
+		case <-time.After(c.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CheckAll checks the destination of every link once, no faster than Rate and with at most
+// Concurrency requests at a time. Links with placeholders are skipped, since their destination
+// depends on the path they are used with.
+func (c *linkChecker) CheckAll(ctx context.Context) {
+	links := slices.DeleteFunc(c.DB.All(), func(l Link) bool { return placeholderRe.MatchString(l.Destination) })
+	log.Printf("Checking the destinations of %d golinks\n", len(links))
+
+	jobs := make(chan Link)
+	var limit <-chan time.Time
+	if c.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / c.Rate))
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+	wg := sync.WaitGroup{}
+	for range c.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range jobs {
+				h := c.Check(ctx, l.Destination)
+				if ctx.Err() != nil {
+					continue // Stopping; the request was canceled
+				}
+				if h.Broken {
+					log.Printf("Link go/%s is broken: %s (HTTP %d) %s\n", l.Display, h.Destination, h.Status, h.Error)
+				}
+				c.DB.setHealth(l.Source, h)
+			}
+		}()
+	}
+send:
+	for _, l := range links {
+		if limit != nil {
+			select {
+			case <-limit:
+			case <-ctx.Done():
+				break send
+			}
+		}
+		select {
+		case jobs <- l:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	c.DB.pruneHealth()
+	broken := 0
+	for _, h := range c.DB.AllHealth() {
+		if h.Broken {
+			broken++
+		}
+	}
+	log.Printf("Checked golink destinations; %d are broken\n", broken)
+}
+
+// Check requests dest with HEAD, falling back to GET for servers that don't support HEAD.
+// The destination is broken if the request fails, the page is gone (404 or 410) or the server
+// errors (5xx). Other statuses, such as 401 and 403 for pages behind a login or 429 when rate
+// limited, show that the destination exists.
+func (c *linkChecker) Check(ctx context.Context, dest string) linkHealth {
+	h := linkHealth{Destination: dest, Checked: time.Now()}
+	status, err := c.request(ctx, http.MethodHead, dest)
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented || status == http.StatusForbidden) {
+		status, err = c.request(ctx, http.MethodGet, dest)
+	}
+	h.Status = status
+	if err != nil {
+		h.Error = err.Error()
+	}
+	h.Broken = err != nil || status == http.StatusNotFound || status == http.StatusGone || status >= 500
+	return h
+}
+
+func (c *linkChecker) request(ctx context.Context, method string, dest string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, dest, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("gohome/%s (link checker)", version))
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Read a little of the body so the connection may be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// Health returns the last check of the link with the given source, or nil if it hasn't been checked.
+func (db *LinkDB) Health(source string) *linkHealth {
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	h, ok := db.health[source]
+	if !ok {
+		return nil
+	}
+	return &h
+}
+
+// AllHealth returns the last check of every checked link, by source.
+func (db *LinkDB) AllHealth() map[string]linkHealth {
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	return maps.Clone(db.health)
+}
+
+func (db *LinkDB) setHealth(source string, h linkHealth) {
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	if db.health == nil {
+		db.health = map[string]linkHealth{}
+	}
+	db.health[source] = h
+}
+
+// pruneHealth forgets the checks of links that were removed or whose destination changed.
+func (db *LinkDB) pruneHealth() {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	for src, h := range db.health {
+		if l, ok := db.links[src]; !ok || l.Destination != h.Destination {
+			delete(db.health, src)
+		}
+	}
+}
+
+// linkHealthInfo is a link with the result of its last check, as served by /_/api/health.
+type linkHealthInfo struct {
+	Link
+	Health *linkHealth
+}
+
+// handleApiHealth serves /_/api/health and /_/api/health/<name>. ?broken=1 lists only broken links.
+func (g *goHttp) handleApiHealth(db *LinkDB, name string) error {
+	w, r := g.W, g.R
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return apiError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+	if name != "" {
+		l := db.Lookup(name)
+		if l == nil {
+			return apiError(w, http.StatusNotFound, "Link %s not found", name)
+		}
+		return writeJson(w, http.StatusOK, linkHealthInfo{*l, db.Health(l.Source)})
+	}
+	health := db.AllHealth()
+	onlyBroken := r.URL.Query().Get("broken") == "1"
+	infos := []linkHealthInfo{}
+	for _, l := range db.All() {
+		h, ok := health[l.Source]
+		if onlyBroken && !(ok && h.Broken) {
+			continue
+		}
+		info := linkHealthInfo{Link: l}
+		if ok {
+			info.Health = &h
+		}
+		infos = append(infos, info)
+	}
+	return writeJson(w, http.StatusOK, infos)
+}
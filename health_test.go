@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLinkChecker(t *testing.T) {
+	mu := sync.Mutex{}
+	inFlight, maxInFlight := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		time.Sleep(10 * time.Millisecond)
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case r.URL.Path == "/nohead" && r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.URL.Path == "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Path == "/gone":
+			w.WriteHeader(http.StatusGone)
+		case r.URL.Path == "/login":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/private":
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path == "/limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	db := &LinkDB{}
+	db.Update([]Link{
+		{Display: "ok", Destination: srv.URL + "/ok"},
+		{Display: "ok2", Destination: srv.URL + "/ok2"},
+		{Display: "missing", Destination: srv.URL + "/missing"},
+		{Display: "nohead", Destination: srv.URL + "/nohead"},
+		{Display: "error", Destination: srv.URL + "/error"},
+		{Display: "gone", Destination: srv.URL + "/gone"},
+		{Display: "login", Destination: srv.URL + "/login"},
+		{Display: "private", Destination: srv.URL + "/private"},
+		{Display: "limited", Destination: srv.URL + "/limited"},
+		{Display: "bad", Destination: srv.URL + "/bad"},
+		{Display: "unreachable", Destination: "http://127.0.0.1:1/"},
+		{Display: "param", Destination: srv.URL + "/missing/{1}"},
+	})
+	c := newLinkChecker(db, time.Hour, 1000, 2, 5*time.Second)
+	c.CheckAll(context.Background())
+
+	tests := []struct {
+		name       string
+		wantStatus int
+		wantBroken bool
+	}{
+		{"ok", http.StatusOK, false},
+		{"missing", http.StatusNotFound, true},
+		{"nohead", http.StatusOK, false},
+		{"error", http.StatusInternalServerError, true},
+		{"gone", http.StatusGone, true},
+		{"login", http.StatusUnauthorized, false},
+		{"private", http.StatusForbidden, false},
+		{"limited", http.StatusTooManyRequests, false},
+		{"bad", http.StatusBadRequest, false},
+		{"unreachable", 0, true},
+	}
+	for _, tc := range tests {
+		h := db.Health(tc.name)
+		if h == nil || h.Status != tc.wantStatus || h.Broken != tc.wantBroken || h.Checked.IsZero() {
+			t.Errorf("Health(%q) = %+v, want status %d broken %v", tc.name, h, tc.wantStatus, tc.wantBroken)
+		}
+	}
+	if h := db.Health("param"); h != nil {
+		t.Errorf("Health(param) = %+v, want links with placeholders skipped", h)
+	}
+	if maxInFlight > 2 {
+		t.Errorf("%d requests were in flight at once, want at most 2", maxInFlight)
+	}
+
+	// Results for links whose destination changed are dropped
+	db.Put(Link{Display: "missing", Destination: srv.URL + "/ok"})
+	db.pruneHealth()
+	if h := db.Health("missing"); h != nil {
+		t.Errorf("Health(missing) = %+v after changing its destination, want nil", h)
+	}
+
+	req := httptest.NewRequest("GET", "/_/api/health?broken=1", nil)
+	rr := httptest.NewRecorder()
+	g := goHttp{W: rr, R: req}
+	if err := g.handleApiHealth(db, ""); err != nil {
+		t.Fatal(err)
+	}
+	infos := []linkHealthInfo{}
+	if err := json.NewDecoder(rr.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 || infos[0].Display != "error" || infos[1].Display != "gone" || infos[2].Display != "unreachable" {
+		t.Errorf("GET %s = %+v, want error, gone and unreachable", req.URL, infos)
+	}
+
+	req = httptest.NewRequest("GET", "/_/view", nil)
+	rr = httptest.NewRecorder()
+	g = goHttp{W: rr, R: req}
+	if err := g.handleView(db); err != nil {
+		t.Fatal(err)
+	}
+	if body := rr.Body.String(); strings.Count(body, ">broken") != 3 {
+		t.Errorf("GET /_/view flagged %d links as broken, want 3", strings.Count(body, ">broken"))
+	}
+}
+
+func TestLinkCheckerRate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	db := &LinkDB{}
+	for _, n := range []string{"a", "b", "c", "d", "e"} {
+		db.Put(Link{Display: n, Destination: srv.URL + "/" + n})
+	}
+	start := time.Now()
+	newLinkChecker(db, time.Hour, 50, 5, time.Second).CheckAll(context.Background())
+	// The first request waits for a tick too
+	if d := time.Since(start); d < 5*time.Second/50 {
+		t.Errorf("Checking 5 links at 50/s took %s, want at least %s", d, 5*time.Second/50)
+	}
+}
@@ -5,12 +5,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"slices"
 	"strings"
 	"time"
 )
 
-func serveHttp(ctx context.Context, db *LinkDB, hostnames []string) error {
+func serveHttp(ctx context.Context, db *LinkDB, ls httpListeners, hostnames []string) error {
 	http.HandleFunc("/", httpErrorWrap(
 		func(w *bufWriter, r *http.Request, err error) {
 			serr := "nil"
@@ -20,37 +21,126 @@ func serveHttp(ctx context.Context, db *LinkDB, hostnames []string) error {
 			log.Printf("Handled request from %s: %s %s (HTTP %d, %d bytes, error=%s)\n", r.RemoteAddr, r.Method, r.URL.Path, w.Code, w.Body.Len(), serr)
 		},
 		func(w http.ResponseWriter, r *http.Request) error {
-			g := goHttp{w, r}
-			p := strings.TrimPrefix(r.URL.Path, "/")
-
-			switch {
-			case p == "":
-				return g.handleRoot()
-			case p == "_/pref":
-				return g.handlePref()
-			case p == "_/view":
-				return g.handleView(db)
-			case p == "favicon.ico":
-				fallthrough
-			case strings.HasPrefix(p, ".well-known"):
-				fallthrough
-			case strings.HasPrefix(p, "."):
-				fallthrough
-			case strings.HasPrefix(p, "_"):
-				w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", 2*time.Hour/time.Second))
-				http.NotFound(w, r)
-				return nil
-			default:
-				return g.handleLink(p, db.Lookup(p), db.FuzzyLookup(p), *flagChain)
+			start := time.Now()
+			g := goHttp{W: w, R: r, Outcome: outcomePage}
+			err := g.route(db)
+			if err != nil {
+				g.Outcome = outcomeError
 			}
+			metrics.ObserveRequest(g.Outcome, time.Since(start))
+			return err
 		}))
 
-	return listen(ctx, *flagBind, hostnames)
+	if ls.Redirect != nil {
+		go func() {
+			if err := listenRedirect(ctx, ls.Redirect, *flagBind); err != nil && err != http.ErrServerClosed {
+				log.Printf("Could not redirect HTTP to HTTPS: %s\n", err)
+			}
+		}()
+	}
+	return listen(ctx, ls.Main, hostnames, ls.TLS)
 }
 
+// prefNames are the per-user preferences that may be set with /_/pref.
+var prefNames = []string{"no-redirect", "no-chain"}
+
 type goHttp struct {
 	W http.ResponseWriter
 	R *http.Request
+
+	Outcome string // For metrics; one of the outcome constants
+}
+
+func (g *goHttp) route(db *LinkDB) error {
+	w, r := g.W, g.R
+	p := strings.TrimPrefix(r.URL.Path, "/")
+
+	if crossSite(r) {
+		http.Error(w, "Cross-site requests can't change links", http.StatusForbidden)
+		return nil
+	}
+	switch {
+	case p == "":
+		return g.handleRoot()
+	case p == "_/pref":
+		return g.handlePref()
+	case p == "_/view":
+		return g.handleView(db)
+	case p == "_/collisions":
+		return g.handleCollisions(db)
+	case p == "_/api/collisions":
+		g.Outcome = outcomeApi
+		return writeJson(w, http.StatusOK, db.Collisions())
+	case p == "_/search":
+		return g.handleSearch(db)
+	case p == "_/edit":
+		return g.handleEdit(db)
+	case p == "_/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		metrics.Write(w, db)
+		return nil
+	case p == "_/api/search":
+		g.Outcome = outcomeApi
+		return g.handleApiSearch(db)
+	case p == "_/opensearch.xml":
+		return g.handleOpenSearch()
+	case p == "_/api/suggest":
+		g.Outcome = outcomeApi
+		return g.handleSuggest(db)
+	case p == "_/api/sync":
+		g.Outcome = outcomeApi
+		return writeJson(w, http.StatusOK, lastSync)
+	case p == "_/api/clicks" || strings.HasPrefix(p, "_/api/clicks/"):
+		g.Outcome = outcomeApi
+		return g.handleApiClicks(db, strings.Trim(strings.TrimPrefix(p, "_/api/clicks"), "/"))
+	case p == "_/api/health" || strings.HasPrefix(p, "_/api/health/"):
+		g.Outcome = outcomeApi
+		return g.handleApiHealth(db, strings.Trim(strings.TrimPrefix(p, "_/api/health"), "/"))
+	case p == "_/api/links" || strings.HasPrefix(p, "_/api/links/"):
+		g.Outcome = outcomeApi
+		return g.handleApiLinks(db, strings.Trim(strings.TrimPrefix(p, "_/api/links"), "/"))
+	case p == "favicon.ico":
+		fallthrough
+	case strings.HasPrefix(p, ".well-known"):
+		fallthrough
+	case strings.HasPrefix(p, "."):
+		fallthrough
+	case strings.HasPrefix(p, "_"):
+		g.Outcome = outcomeReserved
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", 2*time.Hour/time.Second))
+		http.NotFound(w, r)
+		return nil
+	default:
+		l, rest := db.PrefixLookup(p)
+		if l != nil && g.getPref("no-redirect", "0") == "0" {
+			db.RecordClick(l.Source, time.Now())
+		}
+		var health *linkHealth
+		if l != nil {
+			health = db.Health(l.Source)
+		}
+		return g.handleLink(p, l, health, rest, db.FuzzyLookup(p), *flagChain)
+	}
+}
+
+// crossSite reports whether r would change something and was sent by a browser from another site,
+// e.g. by a form on a web page posting to /_/edit. Requests that aren't from a browser, like curl
+// ones, have neither Sec-Fetch-Site nor Origin.
+func crossSite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
 }
 
 func executeTmpl(w http.ResponseWriter, status int, titleSuffix string, tplName string, data any) error {
@@ -86,7 +176,7 @@ func (g *goHttp) setPref(key string, v string) error {
 		Path:     "/",
 		MaxAge:   int(10 * 365 * 24 * time.Hour / time.Second), // Ten years
 		HttpOnly: true,
-		Secure:   false,                // We serve HTTP, not HTTPS. Also, prefs are not sensitive.
+		Secure:   g.R.TLS != nil,       // Prefs are not sensitive, but don't downgrade them from HTTPS
 		SameSite: http.SameSiteLaxMode, // SameSite=None requires Secure=true
 	}
 	http.SetCookie(g.W, cookie)
@@ -99,37 +189,64 @@ func (g *goHttp) handleRoot() error {
 		NoChain    string
 		AddLinkUrl string
 		CanChain   bool
-	}{g.getPref("no-redirect", "0"), g.getPref("no-chain", "0"), *flagAddLinkUrl, *flagChain != ""}
+	}{g.getPref("no-redirect", "0"), g.getPref("no-chain", "0"), addLinkUrl(""), *flagChain != ""}
 	return executeTmpl(g.W, http.StatusOK, "", "index.tmpl", data)
 }
 
 func (g *goHttp) handleView(db *LinkDB) error {
+	q := g.R.URL.Query()
+	links := db.allLinkClicks(time.Now(), q.Get("sort"))
+	tag := strings.TrimSpace(q.Get("tag"))
+	if tag != "" {
+		links = slices.DeleteFunc(links, func(l linkClicks) bool { return !l.HasTag(tag) })
+	}
 	data := struct {
-		Links  map[string]Link
+		Links  []linkClicks
+		Health map[string]linkHealth
 		Prefix string
-	}{db.links, g.R.Host}
+		Tag    string
+	}{links, db.AllHealth(), g.R.Host, tag}
 	return executeTmpl(g.W, http.StatusOK, " - View", "view.tmpl", data)
 }
 
-func (g *goHttp) handleLink(name string, l *Link, fuzzyl []*Link, chainUrl string) error {
+// handleLink redirects to the link l, which matched name up to the remaining path rest.
+// health is the last check of the link's destination, if any.
+func (g *goHttp) handleLink(name string, l *Link, health *linkHealth, rest string, fuzzyl []*Link, chainUrl string) error {
 	if l == nil {
 		return g.linkMissing(name, fuzzyl, chainUrl)
 	}
-	return g.linkFound(l)
+	return g.linkFound(l, health, rest)
+}
+
+// redirectQuery returns the query parameters of the request that should be passed on to a link destination.
+func (g *goHttp) redirectQuery() url.Values {
+	q := g.R.URL.Query()
+	for _, k := range prefNames {
+		q.Del(k)
+	}
+	return q
 }
 
-func (g *goHttp) linkFound(link *Link) error {
-	log.Printf("Found link go/%s -> %s\n", link.Display, link.Destination)
+func (g *goHttp) linkFound(link *Link, health *linkHealth, rest string) error {
+	g.Outcome = outcomeFound
+	dest := expandDestination(link.Destination, rest, g.redirectQuery())
+	log.Printf("Found link go/%s -> %s\n", link.Display, dest)
 	if g.getPref("no-redirect", "0") == "0" {
-		http.Redirect(g.W, g.R, link.Destination, http.StatusTemporaryRedirect)
+		http.Redirect(g.W, g.R, dest, http.StatusTemporaryRedirect)
 		return nil
 	}
 	data := struct {
 		*Link
-		Prefix string
+		Prefix   string
+		Redirect string
+		Health   *linkHealth
+		Form     *linkForm
 	}{
 		link,
 		g.R.Host,
+		dest,
+		health,
+		newLinkForm(link, link.Display, g.R.Host),
 	}
 	return executeTmpl(g.W, http.StatusOK, fmt.Sprintf(" - %s/%s", g.R.Host, link.Display), "linkinfo.tmpl", data)
 }
@@ -143,6 +260,7 @@ func (g *goHttp) linkMissing(name string, fuzzyl []*Link, chainUrl string) error
 	}
 	if chainUrl != "" {
 		if g.getPref("no-redirect", "0") == "0" && g.getPref("no-chain", "0") == "0" {
+			g.Outcome = outcomeChained
 			log.Printf("Missing link go/%s; chaining to %s\n", name, redir)
 			http.Redirect(g.W, g.R, redir, http.StatusTemporaryRedirect)
 			return nil
@@ -151,13 +269,122 @@ func (g *goHttp) linkMissing(name string, fuzzyl []*Link, chainUrl string) error
 	} else {
 		log.Printf("Missing link go/%s; chaining not configured", name)
 	}
+	g.Outcome = outcomeNotFound
+	if len(fuzzyl) > 0 {
+		g.Outcome = outcomeFuzzy404
+	}
 	return executeTmpl(g.W, http.StatusNotFound, fmt.Sprintf(" - 404 %s/%s not found", g.R.Host, name), "not_found.tmpl", struct {
 		Name       string
 		ChainTo    string
 		AddLinkUrl string
 		Prefix     string
 		FuzzyLinks []*Link
-	}{name, redir, *flagAddLinkUrl, g.R.Host, fuzzyl})
+		Form       *linkForm
+	}{name, redir, addLinkUrl(name), g.R.Host, fuzzyl, newLinkForm(&Link{Display: name}, "", g.R.Host)})
+}
+
+// addLinkUrl returns the url to offer for adding the named link, preferring --add-link-url over the local form.
+func addLinkUrl(name string) string {
+	if *flagAddLinkUrl != "" || !*flagEdit {
+		return *flagAddLinkUrl
+	}
+	if name == "" {
+		return "/_/edit"
+	}
+	return "/_/edit?name=" + url.QueryEscape(name)
+}
+
+// linkForm is the data for link_form.tmpl.
+type linkForm struct {
+	Link
+	Original string // Display name of the link being edited; empty for a new link
+	Prefix   string
+	Error    string
+}
+
+// TagsValue returns the tags of the link as entered in the form.
+func (f *linkForm) TagsValue() string {
+	return strings.Join(f.Tags, ", ")
+}
+
+// AliasesValue returns the aliases of the link as entered in the form.
+func (f *linkForm) AliasesValue() string {
+	return strings.Join(f.Aliases, ", ")
+}
+
+func newLinkForm(l *Link, original string, prefix string) *linkForm {
+	if !*flagEdit {
+		return nil
+	}
+	return &linkForm{*l, original, prefix, ""}
+}
+
+func (g *goHttp) handleEdit(db *LinkDB) error {
+	if !*flagEdit {
+		http.Error(g.W, "Editing is disabled", http.StatusForbidden)
+		return nil
+	}
+	if g.R.Method != http.MethodPost {
+		name := g.R.URL.Query().Get("name")
+		l := db.Lookup(name)
+		original := ""
+		if l == nil {
+			l = &Link{Display: name}
+		} else {
+			original = l.Display
+		}
+		title := " - Add link"
+		if original != "" {
+			title = fmt.Sprintf(" - Edit %s/%s", g.R.Host, original)
+		}
+		return executeTmpl(g.W, http.StatusOK, title, "edit.tmpl", newLinkForm(l, original, g.R.Host))
+	}
+
+	if err := g.R.ParseForm(); err != nil {
+		return err
+	}
+	original := g.R.PostForm.Get("original")
+	if g.R.PostForm.Has("delete") {
+		l, ok := db.Delete(original)
+		if !ok {
+			http.Error(g.W, fmt.Sprintf("Link %s not found", original), http.StatusNotFound)
+			return nil
+		}
+		log.Printf("Deleted link go/%s\n", l.Display)
+		if err := saveLinks(db, nil, []string{l.Source}); err != nil {
+			return err
+		}
+		http.Redirect(g.W, g.R, "/_/view", http.StatusSeeOther)
+		return nil
+	}
+
+	l := Link{
+		Display:     g.R.PostForm.Get("display"),
+		Destination: g.R.PostForm.Get("destination"),
+		Owner:       g.R.PostForm.Get("owner"),
+		Description: g.R.PostForm.Get("description"),
+		Tags:        splitList(g.R.PostForm.Get("tags")),
+		Aliases:     splitList(g.R.PostForm.Get("aliases")),
+		Origin:      originLocal,
+		Author:      g.author(),
+	}
+	saved, removed := Link{}, []string{}
+	err := validateLink(&l)
+	if err == nil {
+		saved, removed, _, err = db.Edit(original, l)
+	}
+	if err != nil {
+		f := newLinkForm(&l, original, g.R.Host)
+		f.Error = err.Error()
+		return executeTmpl(g.W, http.StatusBadRequest, " - Invalid link", "edit.tmpl", f)
+	}
+	l = saved
+	log.Printf("Saved link go/%s -> %s\n", l.Display, l.Destination)
+	if err := saveLinks(db, []Link{l}, removed); err != nil {
+		return err
+	}
+	http.Redirect(g.W, g.R, "/"+url.PathEscape(l.Display)+"?no-redirect=1", http.StatusSeeOther)
+	return nil
 }
 
 func (g *goHttp) handlePref() error {
@@ -165,7 +392,7 @@ func (g *goHttp) handlePref() error {
 	k := q.Get("k")
 	set := q.Has("v")
 	v := q.Get("v")
-	if !slices.Contains([]string{"no-redirect", "no-chain"}, k) {
+	if !slices.Contains(prefNames, k) {
 		return executeTmpl(g.W, http.StatusNotFound, " - Preference not found", "bad_preference.tmpl", struct{ Name string }{k})
 	}
 	if set {
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"html/template"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	tmpl = template.Must(template.ParseFS(content, "templates/*.tmpl"))
+	os.Exit(m.Run())
+}
+
 func TestGetPref(t *testing.T) {
 	tests := []struct {
 		desc   string
@@ -94,3 +102,21 @@ func TestSetPref(t *testing.T) {
 		t.Errorf("g.setPref('test', 'cowboy') = %v, want %v", cookie.Value, "cowboy")
 	}
 }
+
+func TestViewTag(t *testing.T) {
+	db := &LinkDB{}
+	db.Update([]Link{
+		{Display: "wiki", Destination: "http://wiki/", Tags: []string{"docs"}},
+		{Display: "bugs", Destination: "http://bugs/", Tags: []string{"eng"}},
+	})
+	req := httptest.NewRequest("GET", "/_/view?tag=Docs", nil)
+	rr := httptest.NewRecorder()
+	g := goHttp{W: rr, R: req}
+	if err := g.handleView(db); err != nil {
+		t.Fatal(err)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "http://wiki/") || strings.Contains(body, "http://bugs/") {
+		t.Errorf("GET %s did not show only the links tagged docs:\n%s", req.URL, body)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"maps"
+	"mime"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// linkImporter parses links downloaded from a remote in one format.
+type linkImporter struct {
+	Name         string
+	ContentTypes []string
+	Extensions   []string
+	Parse        func(data []byte) ([]Link, error)
+}
+
+var linkImporters = []*linkImporter{
+	{"json", []string{"application/json"}, []string{".json"}, importJson},
+	{"jsonl", []string{"application/jsonl", "application/x-ndjson", "application/jsonlines"}, []string{".jsonl", ".ndjson"}, importJsonLines},
+	{"csv", []string{"text/csv"}, []string{".csv"}, importCsv},
+	{"yaml", []string{"application/yaml", "application/x-yaml", "text/yaml"}, []string{".yaml", ".yml"}, importYaml},
+	{"bookmarks", []string{"text/html"}, []string{".html", ".htm"}, importBookmarks},
+}
+
+// acceptLinkTypes is sent as the Accept header when downloading links.
+var acceptLinkTypes = func() string {
+	types := []string{}
+	for _, imp := range linkImporters {
+		types = append(types, imp.ContentTypes...)
+	}
+	return strings.Join(types, ", ") + ", */*;q=0.1"
+}()
+
+func findImporter(name string) *linkImporter {
+	for _, imp := range linkImporters {
+		if imp.Name == name {
+			return imp
+		}
+	}
+	return nil
+}
+
+// importLinks parses data with the importer named by format, or if that is empty, the one
+// matching the response's content type, the extension of the url, or the data itself.
+func importLinks(format string, contentType string, url string, data []byte) ([]Link, error) {
+	imp := findImporter(format)
+	if format != "" && imp == nil {
+		return nil, fmt.Errorf("Unknown link format '%s'", format)
+	}
+	if imp == nil {
+		if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+			for _, i := range linkImporters {
+				if slices.Contains(i.ContentTypes, mt) {
+					imp = i
+				}
+			}
+		}
+	}
+	if imp == nil {
+		ext := path.Ext(strings.SplitN(url, "?", 2)[0])
+		for _, i := range linkImporters {
+			if slices.Contains(i.Extensions, strings.ToLower(ext)) {
+				imp = i
+			}
+		}
+	}
+	if imp == nil {
+		imp = sniffImporter(data)
+	}
+	links, err := imp.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", imp.Name, err)
+	}
+	return links, nil
+}
+
+func sniffImporter(data []byte) *linkImporter {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return findImporter("jsonl")
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return findImporter("bookmarks")
+	}
+	return findImporter("json")
+}
+
+// importedLink has the fields used by gohome and other golinks services for a link.
+// JSON decoding ignores case, so e.g. "display" and "Display" both match Display.
+type importedLink struct {
+	// gohome
+	Source      string    `yaml:"source"`
+	Display     string    `yaml:"display"`
+	Destination string    `yaml:"destination"`
+	Owner       string    `yaml:"owner"`
+	Description string    `yaml:"description"`
+	Tags        []string  `yaml:"tags"`
+	Aliases     []string  `yaml:"aliases"`
+	Created     time.Time `yaml:"created"`
+	Updated     time.Time `yaml:"updated"`
+	Author      string    `yaml:"author"`
+
+	// Tailscale golink
+	Short    string    `yaml:"short"`
+	Long     string    `yaml:"long"`
+	LastEdit time.Time `yaml:"lastedit"`
+
+	// Trotto
+	Shortpath      string `json:"shortpath" yaml:"shortpath"`
+	DestinationUrl string `json:"destination_url" yaml:"destination_url"`
+
+	// Common alternatives
+	Name string `yaml:"name"`
+	Url  string `yaml:"url"`
+}
+
+func (il importedLink) link() (Link, error) {
+	l := Link{
+		Source:      il.Source,
+		Display:     firstNonEmpty(il.Display, il.Short, strings.TrimPrefix(il.Shortpath, "go/"), il.Name, il.Source),
+		Destination: firstNonEmpty(il.Destination, il.Long, il.DestinationUrl, il.Url),
+		Owner:       il.Owner,
+		Description: il.Description,
+		Tags:        normalizeTags(il.Tags),
+		Aliases:     il.Aliases,
+		Created:     il.Created,
+		Updated:     il.Updated,
+		Author:      il.Author,
+	}
+	if l.Updated.IsZero() {
+		l.Updated = il.LastEdit
+	}
+	if l.Display == "" || l.Destination == "" {
+		return l, fmt.Errorf("Link requires a name and destination: %+v", il)
+	}
+	return l, nil
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func importedLinks(ils []importedLink) ([]Link, error) {
+	links := make([]Link, 0, len(ils))
+	for _, il := range ils {
+		l, err := il.link()
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// importJson parses a JSON array of links, as written by gohome or exported by Trotto.
+func importJson(data []byte) ([]Link, error) {
+	ils := []importedLink{}
+	if err := json.Unmarshal(data, &ils); err != nil {
+		return nil, err
+	}
+	return importedLinks(ils)
+}
+
+// importJsonLines parses one JSON link per line, as exported by Tailscale golink.
+func importJsonLines(data []byte) ([]Link, error) {
+	ils := []importedLink{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		il := importedLink{}
+		if err := json.Unmarshal(line, &il); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		ils = append(ils, il)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return importedLinks(ils)
+}
+
+// importCsv parses CSV with a header row naming the columns (e.g. display,destination,owner,tags).
+// Without a recognized header the columns are taken to be name, destination, owner and description.
+func importCsv(data []byte) ([]Link, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []Link{}, nil
+	}
+	nameCol, destCol, ownerCol, descCol, tagsCol := 0, 1, 2, 3, -1
+	header := map[string]int{}
+	for i, h := range records[0] {
+		header[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	col := func(names ...string) int {
+		for _, n := range names {
+			if i, ok := header[n]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+	if n, d := col("display", "name", "short", "shortpath", "source"), col("destination", "url", "long", "destination_url"); n >= 0 && d >= 0 {
+		nameCol, destCol, ownerCol, descCol, tagsCol = n, d, col("owner"), col("description"), col("tags")
+		records = records[1:]
+	}
+	ils := []importedLink{}
+	for _, rec := range records {
+		field := func(i int) string {
+			if i < 0 || i >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[i])
+		}
+		ils = append(ils, importedLink{Display: field(nameCol), Destination: field(destCol), Owner: field(ownerCol), Description: field(descCol), Tags: splitList(field(tagsCol))})
+	}
+	return importedLinks(ils)
+}
+
+// importYaml parses either a YAML list of links or a mapping of names to destinations.
+func importYaml(data []byte) ([]Link, error) {
+	ils := []importedLink{}
+	if err := yaml.Unmarshal(data, &ils); err == nil {
+		return importedLinks(ils)
+	}
+	m := map[string]string{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("expected a list of links or a mapping of names to destinations: %w", err)
+	}
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		ils = append(ils, importedLink{Display: k, Destination: m[k]})
+	}
+	return importedLinks(ils)
+}
+
+var (
+	bookmarkRe     = regexp.MustCompile(`(?is)<a\s([^>]*)>(.*?)</a>`)
+	bookmarkAttrRe = regexp.MustCompile(`(?is)([a-z_]+)\s*=\s*"([^"]*)"`)
+	tagRe          = regexp.MustCompile(`<[^>]*>`)
+)
+
+// importBookmarks parses a browser bookmark export (the Netscape bookmark file format).
+// The bookmark keyword (SHORTCUTURL) is used as the link name if set, otherwise the title.
+func importBookmarks(data []byte) ([]Link, error) {
+	// Don't mistake an HTML error page for an empty set of bookmarks
+	if !bytes.Contains(bytes.ToUpper(data[:min(len(data), 1024)]), []byte("NETSCAPE-BOOKMARK-FILE")) {
+		return nil, fmt.Errorf("not a bookmark file")
+	}
+	ils := []importedLink{}
+	for _, m := range bookmarkRe.FindAllSubmatch(data, -1) {
+		attrs := map[string]string{}
+		for _, a := range bookmarkAttrRe.FindAllSubmatch(m[1], -1) {
+			attrs[strings.ToLower(string(a[1]))] = html.UnescapeString(string(a[2]))
+		}
+		href := attrs["href"]
+		if !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://") {
+			continue // e.g. javascript: bookmarklets
+		}
+		name := attrs["shortcuturl"]
+		if name == "" {
+			title := html.UnescapeString(tagRe.ReplaceAllString(string(m[2]), ""))
+			name = strings.Join(strings.Fields(title), "-")
+		}
+		if name == "" {
+			continue
+		}
+		ils = append(ils, importedLink{Display: name, Destination: href})
+	}
+	return importedLinks(ils)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestImportLinks(t *testing.T) {
+	want := []Link{
+		{Display: "foo-bar", Destination: "http://example.org/foo", Owner: "me"},
+		{Display: "wiki", Destination: "http://example.org/wiki"},
+	}
+	tests := []struct {
+		desc        string
+		format      string
+		contentType string
+		url         string
+		data        string
+	}{
+		{"gohome json", "", "application/json", "", `[{"display": "foo-bar", "destination": "http://example.org/foo", "owner": "me"}, {"Display": "wiki", "Destination": "http://example.org/wiki"}]`},
+		{"trotto json", "", "", "http://x/links.json", `[{"shortpath": "go/foo-bar", "destination_url": "http://example.org/foo", "owner": "me"}, {"shortpath": "wiki", "destination_url": "http://example.org/wiki"}]`},
+		{"tailscale jsonl", "", "", "http://x/.export", "{\"Short\":\"foo-bar\",\"Long\":\"http://example.org/foo\",\"Owner\":\"me\"}\n\n{\"Short\":\"wiki\",\"Long\":\"http://example.org/wiki\"}\n"},
+		{"csv with header", "", "text/csv; charset=utf-8", "", "owner,name,url\nme,foo-bar,http://example.org/foo\n,wiki,http://example.org/wiki\n"},
+		{"csv without header", "csv", "text/plain", "", "foo-bar,http://example.org/foo,me\nwiki,http://example.org/wiki\n"},
+		{"yaml list", "", "", "http://x/links.yaml?raw=1", "- display: foo-bar\n  destination: http://example.org/foo\n  owner: me\n- name: wiki\n  url: http://example.org/wiki\n"},
+		{"bookmarks", "", "text/html", "", `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<DL><p>
+<DT><A HREF="http://example.org/foo" SHORTCUTURL="foo-bar" ADD_DATE="1">Foo</A>
+<DT><A HREF="javascript:alert(1)">Bookmarklet</A>
+<DT><A HREF="http://example.org/wiki">wiki</A>
+</DL>`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := importLinks(tc.format, tc.contentType, tc.url, []byte(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := want
+			if tc.format == "" && tc.contentType == "text/html" {
+				// Bookmarks don't have owners
+				want = slices.Clone(want)
+				want[0].Owner = ""
+			}
+			if !slices.EqualFunc(got, want, Link.Equal) {
+				t.Errorf("importLinks() = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	got, err := importLinks("yaml", "", "", []byte("foo: http://example.org/foo\nbar: http://example.org/bar\n"))
+	if err != nil || len(got) != 2 || got[0].Display != "bar" {
+		t.Errorf("importLinks() of a YAML mapping = %+v, %v", got, err)
+	}
+	if _, err := importLinks("", "text/html", "", []byte("<html>500 Internal Server Error</html>")); err == nil {
+		t.Errorf("importLinks() of an HTML error page succeeded, want an error")
+	}
+	if _, err := importLinks("", "", "", []byte(`[{"display": "nodest"}]`)); err == nil {
+		t.Errorf("importLinks() of a link without a destination succeeded, want an error")
+	}
+}
@@ -1,18 +1,73 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 type Link struct {
 	Source      string // Canonicalized link name
 	Destination string
 
-	Display string // Entered / display link name (e.g. with dashes)
-	Owner   string
+	Display     string // Entered / display link name (e.g. with dashes)
+	Owner       string
+	Description string
+	Tags        []string `json:",omitempty"` // Lowercase and sorted
+	Aliases     []string `json:",omitempty"` // Other names that resolve to this link, as entered
+
+	Created time.Time `json:",omitzero"`
+	Updated time.Time `json:",omitzero"`
+	Author  string    `json:",omitempty"` // Who last edited the link, from --author-header
+
+	Origin string // Where the link came from: originLocal, the name of a remote source, or empty if unknown (e.g. from an older cache)
+}
+
+// Equal reports whether two links are identical.
+func (l Link) Equal(o Link) bool {
+	return l.Source == o.Source && l.Destination == o.Destination && l.Display == o.Display && l.Owner == o.Owner &&
+		l.Description == o.Description && slices.Equal(l.Tags, o.Tags) && slices.Equal(l.Aliases, o.Aliases) &&
+		l.Created.Equal(o.Created) && l.Updated.Equal(o.Updated) && l.Author == o.Author && l.Origin == o.Origin
+}
+
+// HasTag reports whether the link is tagged with tag.
+func (l Link) HasTag(tag string) bool {
+	return slices.Contains(l.Tags, strings.ToLower(tag))
+}
+
+// Names returns the display name and aliases of the link.
+func (l Link) Names() []string {
+	return append([]string{l.Display}, l.Aliases...)
 }
 
+// splitList splits a comma or space separated list, as entered in a form.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+}
+
+// normalizeTags lowercases, sorts and removes duplicate tags.
+func normalizeTags(tags []string) []string {
+	norm := []string{}
+	for _, t := range tags {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			norm = append(norm, t)
+		}
+	}
+	slices.Sort(norm)
+	return slices.Compact(norm)
+}
+
+const (
+	originLocal  = "local"  // Created or edited through the web interface or API; never overwritten or removed by a sync
+	originRemote = "remote" // The name of the source given by --remote
+)
+
 // maybeFixLinkSource sets the Source of a link to the canonicalized display name of the link.
 func maybeFixLinkSource(l *Link) bool {
 	canonicalizedDisplay := canonicalizeLink(l.Display)
@@ -24,10 +79,102 @@ func maybeFixLinkSource(l *Link) bool {
 	return false
 }
 
+// validateLink checks that a user-submitted link can be stored and served.
+func validateLink(l *Link) error {
+	l.Display = strings.Trim(strings.TrimSpace(l.Display), "/")
+	l.Destination = strings.TrimSpace(l.Destination)
+	l.Owner = strings.TrimSpace(l.Owner)
+	l.Description = strings.TrimSpace(l.Description)
+	l.Tags = normalizeTags(l.Tags)
+	if l.Display == "" || canonicalizeLink(l.Display) == "" {
+		return fmt.Errorf("A link name is required")
+	}
+	aliases := []string{}
+	for _, a := range l.Aliases {
+		a = strings.Trim(strings.TrimSpace(a), "/")
+		if canonicalizeLink(a) == "" || canonicalizeLink(a) == canonicalizeLink(l.Display) {
+			continue
+		}
+		if !slices.ContainsFunc(aliases, func(b string) bool { return canonicalizeLink(a) == canonicalizeLink(b) }) {
+			aliases = append(aliases, a)
+		}
+	}
+	l.Aliases = aliases
+	for _, n := range l.Names() {
+		if strings.HasPrefix(n, "_") || strings.HasPrefix(n, ".") {
+			return fmt.Errorf("Link names starting with '_' or '.' are reserved")
+		}
+	}
+	u, err := url.Parse(l.Destination)
+	if err != nil {
+		return fmt.Errorf("Invalid destination: %w", err)
+	}
+	// Other schemes such as javascript: would run in the context of whatever page follows the link
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Destination must be an absolute http or https URL, got '%s'", l.Destination)
+	}
+	return nil
+}
+
 func canonicalizeLink(l string) string {
-	l = strings.ToLower(l)
-	l = strings.ReplaceAll(l, ".", "")
-	l = strings.ReplaceAll(l, "-", "")
-	l = strings.ReplaceAll(l, "_", "")
-	return l
+	return linkCanon.Canonicalize(l)
+}
+
+var placeholderRe = regexp.MustCompile(`\{(\*|[1-9][0-9]*)\}|%s`)
+
+// expandDestination builds the redirect target for a link given the path remaining after the link name
+// and the query of the incoming request.
+//
+// If the destination contains placeholders they are substituted: {*} and %s expand to the whole remaining
+// path and {1}, {2}, ... to its individual segments. Otherwise a non-empty remaining path is appended to
+// the destination's path. Query parameters from the request are appended to the destination's query, which is kept as is.
+func expandDestination(dest string, rest string, query url.Values) string {
+	segments := []string{}
+	if rest != "" {
+		segments = strings.Split(rest, "/")
+	}
+	if placeholderRe.MatchString(dest) {
+		// Escape differently depending on whether the placeholder is in the query string
+		pth, qs, hasQuery := strings.Cut(dest, "?")
+		expand := func(s string, escape func(string) string) string {
+			return placeholderRe.ReplaceAllStringFunc(s, func(ph string) string {
+				if ph == "{*}" || ph == "%s" {
+					escaped := make([]string, len(segments))
+					for i, seg := range segments {
+						escaped[i] = escape(seg)
+					}
+					return strings.Join(escaped, "/")
+				}
+				n, _ := strconv.Atoi(ph[1 : len(ph)-1])
+				if n > len(segments) {
+					return ""
+				}
+				return escape(segments[n-1])
+			})
+		}
+		dest = expand(pth, url.PathEscape)
+		if hasQuery {
+			dest += "?" + expand(qs, url.QueryEscape)
+		}
+	} else if rest != "" {
+		u, err := url.Parse(dest)
+		if err == nil {
+			u = u.JoinPath(segments...)
+			dest = u.String()
+		}
+	}
+	if len(query) == 0 {
+		return dest
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return dest
+	}
+	// Keep the destination's query as written, reencoding it could change its meaning
+	if u.RawQuery == "" {
+		u.RawQuery = query.Encode()
+	} else {
+		u.RawQuery += "&" + query.Encode()
+	}
+	return u.String()
 }
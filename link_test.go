@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestExpandDestination(t *testing.T) {
+	tests := []struct {
+		desc  string
+		dest  string
+		rest  string
+		query string
+		want  string
+	}{
+		{"plain", "http://example.org/a", "", "", "http://example.org/a"},
+		{"append path", "http://example.org/browse", "PROJ-123", "", "http://example.org/browse/PROJ-123"},
+		{"append path trailing slash", "http://example.org/browse/", "a/b", "", "http://example.org/browse/a/b"},
+		{"append keeps destination query", "http://example.org/browse?x=1", "a", "", "http://example.org/browse/a?x=1"},
+		{"positional", "http://example.org/{2}/issues/{1}", "123/proj", "", "http://example.org/proj/issues/123"},
+		{"positional missing", "http://example.org/{1}/{2}", "a", "", "http://example.org/a/"},
+		{"star", "http://example.org/x/{*}", "a/b c", "", "http://example.org/x/a/b%20c"},
+		{"percent s in query", "http://example.org/search?q=%s", "a b&c", "", "http://example.org/search?q=a+b%26c"},
+		{"merge query", "http://example.org/search?q=1", "", "page=2", "http://example.org/search?q=1&page=2"},
+		{"destination query kept as is", "http://example.org/s?b=2&a=x%2Cy;c", "", "d=1", "http://example.org/s?b=2&a=x%2Cy;c&d=1"},
+		{"merge query with path", "http://example.org/", "a", "q=x", "http://example.org/a?q=x"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			q, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := expandDestination(tc.dest, tc.rest, q); got != tc.want {
+				t.Errorf("expandDestination(%q, %q, %q) = %q, want %q", tc.dest, tc.rest, tc.query, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrefixLookup(t *testing.T) {
+	db := &LinkDB{}
+	db.Update([]Link{
+		{Display: "jira", Destination: "http://jira/"},
+		{Display: "jira/new", Destination: "http://jira/new"},
+	})
+	tests := []struct {
+		name     string
+		wantLink string
+		wantRest string
+	}{
+		{"jira", "jira", ""},
+		{"Jira/PROJ-1", "jira", "PROJ-1"},
+		{"jira/new", "jira/new", ""},
+		{"jira/new/x/y", "jira/new", "x/y"},
+		{"jira/", "jira", ""},
+		{"nope/jira", "", ""},
+	}
+	for _, tc := range tests {
+		l, rest := db.PrefixLookup(tc.name)
+		got := ""
+		if l != nil {
+			got = l.Display
+		}
+		if got != tc.wantLink || rest != tc.wantRest {
+			t.Errorf("PrefixLookup(%q) = (%q, %q), want (%q, %q)", tc.name, got, rest, tc.wantLink, tc.wantRest)
+		}
+	}
+}
+
+func TestAliases(t *testing.T) {
+	db := &LinkDB{}
+	db.Update([]Link{
+		{Display: "wiki", Destination: "http://wiki/", Aliases: []string{"Docs", "w"}},
+		{Display: "bugs", Destination: "http://bugs/"},
+	})
+	for _, name := range []string{"wiki", "docs", "D.O.C.S", "w"} {
+		if l := db.Lookup(name); l == nil || l.Source != "wiki" {
+			t.Errorf("Lookup(%q) = %+v, want wiki", name, l)
+		}
+	}
+	if l, rest := db.PrefixLookup("docs/page"); l == nil || l.Source != "wiki" || rest != "page" {
+		t.Errorf("PrefixLookup(%q) = %+v, %q, want wiki, page", "docs/page", l, rest)
+	}
+	if got := db.FuzzyLookup("doc"); len(got) != 1 || got[0].Source != "wiki" {
+		t.Errorf("FuzzyLookup(%q) = %+v, want only wiki", "doc", got)
+	}
+
+	tests := []struct {
+		l        Link
+		original string
+		wantErr  bool
+	}{
+		{Link{Display: "wiki", Aliases: []string{"docs", "wiki2"}}, "wiki", false},
+		{Link{Display: "new", Aliases: []string{"w"}}, "", true},
+		{Link{Display: "docs"}, "", true},
+		{Link{Display: "bugs", Aliases: []string{"issues"}}, "bugs", false},
+		{Link{Display: "bugs", Aliases: []string{"docs"}}, "bugs", true},
+	}
+	for _, tc := range tests {
+		if err := db.checkNamesLocked(tc.l, tc.original); (err != nil) != tc.wantErr {
+			t.Errorf("checkNamesLocked(%+v, %q) = %v, want error %v", tc.l, tc.original, err, tc.wantErr)
+		}
+	}
+
+	if l, ok := db.Delete("docs"); !ok || l.Source != "wiki" {
+		t.Errorf("Delete(docs) = %+v, %v, want wiki", l, ok)
+	}
+	if l := db.Lookup("w"); l != nil {
+		t.Errorf("Lookup(w) = %+v after deleting its link, want nil", l)
+	}
+}
+
+func TestValidateLinkNormalizes(t *testing.T) {
+	l := Link{Display: "wiki", Destination: "http://wiki/", Tags: []string{" Docs", "team", "docs", ""}, Aliases: []string{"W", "wiki", "w", "/d/"}}
+	if err := validateLink(&l); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"docs", "team"}; !slices.Equal(l.Tags, want) {
+		t.Errorf("Tags = %q, want %q", l.Tags, want)
+	}
+	if want := []string{"W", "d"}; !slices.Equal(l.Aliases, want) {
+		t.Errorf("Aliases = %q, want %q", l.Aliases, want)
+	}
+	l.Aliases = []string{"_reserved"}
+	if err := validateLink(&l); err == nil {
+		t.Errorf("validateLink() with alias _reserved succeeded, want an error")
+	}
+}
+
+func TestValidateLinkDestination(t *testing.T) {
+	tests := []struct {
+		dest string
+		ok   bool
+	}{
+		{"http://wiki/", true},
+		{"https://example.org/a?b=c", true},
+		{"HTTPS://example.org/", true},
+		{"/relative", false},
+		{"example.org", false},
+		{"javascript:alert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"file:///etc/passwd", false},
+		{"mailto:someone@example.org", false},
+		{"http:///nohost", false},
+	}
+	for _, tc := range tests {
+		l := Link{Display: "wiki", Destination: tc.dest}
+		if err := validateLink(&l); (err == nil) != tc.ok {
+			t.Errorf("validateLink() with destination %q = %v, want ok %v", tc.dest, err, tc.ok)
+		}
+	}
+}
@@ -3,18 +3,21 @@ package main
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"slices"
+	"sync"
 	"syscall"
-	"time"
 
 	"github.com/ebnull/gohome/network"
+	"github.com/ebnull/gohome/network/loopback"
 )
 
 var (
@@ -35,89 +38,170 @@ func main() {
 	}
 }
 
-func onCleanupSignalOrDone(doneChan <-chan struct{}, f ...func() error) func() {
-	return func() {
-		sigchan := make(chan os.Signal)
-		signal.Notify(sigchan, os.Interrupt)
-		signal.Notify(sigchan, syscall.SIGTERM)
-		var s os.Signal
-		select {
-		case s = <-sigchan:
-			ss, ok := s.(syscall.Signal)
-			if !ok {
-				log.Printf("Caught signal: %s", s.String())
-			} else {
-				log.Printf("Caught signal %d:  %s", int(ss), ss.String())
-			}
-		case <-doneChan:
-		}
-		signal.Stop(sigchan)
-		for _, f := range f {
-			err := f()
-			if err != nil {
-				log.Print(err)
-			}
-		}
-		if s != nil {
-			ss, ok := s.(syscall.Signal)
-			log.Printf("Reraising signal %s\n", s)
-			if !ok {
-				os.Exit(1)
-			}
-			syscall.Kill(syscall.Getpid(), ss)
-		}
+// setupAutoconfig makes the network changes for --auto mode, returning the resolvable names and
+// a function undoing them. With --helper-socket or --user they are made by the privileged helper,
+// whose connection is returned to be handed off. helperConn is the connection handed off by the
+// process that pid is, which this one takes the changes over from if it isn't 0.
+func setupAutoconfig(helperConn *os.File, pid int) ([]string, func() error, *helperClient, error) {
+	if !slices.Contains([]string{"darwin", "linux"}, runtime.GOOS) {
+		log.Printf("GOOS is %s; skipping loopback alias and editing of /etc/hosts", runtime.GOOS)
+		return nil, func() error { return nil }, nil, nil
 	}
-}
 
-func runBackgroundUpdate(ctx context.Context, db *LinkDB) {
-	if db.Len() == 0 {
-		err := updateLinksFromRemote(db, *flagRemote, *flagCache)
+	var helper *helperClient
+	var err error
+	switch {
+	case helperConn != nil:
+		conn, ferr := net.FileConn(helperConn)
+		helperConn.Close()
+		if ferr != nil {
+			return nil, nil, nil, ferr
+		}
+		helper = newHelperClient(conn)
+		hosts, err := helper.Hosts()
 		if err != nil {
-			log.Printf("Error fetching inital golinks: %s\n", err)
+			helper.Stop()
+			return nil, nil, nil, err
 		}
+		return hosts, helper.Stop, helper, nil
+	case *flagHelperSocket != "":
+		helper, err = dialHelper(*flagHelperSocket)
+	case *flagUser != "":
+		helper, err = spawnHelper()
+	default:
+		hosts, stop, err := autoconfig(pid)
+		return hosts, stop, nil, err
 	}
-	go func(ctx context.Context) {
-		for {
-			select {
-			case <-time.After(*flagUpdateInterval):
-				err := updateLinksFromRemote(db, *flagRemote, *flagCache)
-				if err != nil {
-					log.Printf("Error fetching golinks: %s\n", err)
-				}
-			case <-ctx.Done():
-				return
-			}
-		}
-	}(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hosts, err := helper.Start()
+	if err != nil {
+		helper.Stop()
+		return nil, nil, nil, err
+	}
+	return hosts, helper.Stop, helper, nil
 }
 
-func setupAutoconfig(ctx context.Context) ([]string, error) {
-	if !slices.Contains([]string{"darwin", "linux"}, runtime.GOOS) {
-		log.Printf("GOOS is %s; skipping loopback alias and editing of /etc/hosts", runtime.GOOS)
-		return nil, nil
+// checkAutoconfig returns an error if the network changes for --auto mode couldn't be made,
+// without making them. With a helper its checks are left to it.
+func checkAutoconfig(helperConn *os.File) error {
+	if !slices.Contains([]string{"darwin", "linux"}, runtime.GOOS) || helperConn != nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(*flagBind)
+	if err != nil {
+		return err
+	}
+	am, err := network.NewAliasManager(*flagHostname, host, *flagDnsBind == "")
+	if err != nil {
+		return err
 	}
+	return am.Check()
+}
 
+// autoconfig aliases the --bind address to the loopback interface and makes --hostname resolve to
+// it, taking over the changes of the gohome that pid is if it isn't 0.
+func autoconfig(pid int) ([]string, func() error, error) {
 	host, _, err := net.SplitHostPort(*flagBind)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	am, err := network.NewAliasManager(*flagHostname, host)
+	am, err := network.NewAliasManager(*flagHostname, host, *flagDnsBind == "")
 	if err != nil {
-		return nil, fmt.Errorf("%w\n\nHint: are you root? Try again with sudo.", err)
+		return nil, nil, fmt.Errorf("%w\n\nHint: are you root? Try again with sudo.", err)
 	}
+	am.TakeOverPid = pid
 	err, stop := am.Start()
 	if err != nil {
 		stop()
-		return nil, err
+		if pe := (*loopback.PermissionError)(nil); errors.As(err, &pe) {
+			return nil, nil, fmt.Errorf("%w\n\nHint: are you root? Try again with sudo, or grant CAP_NET_ADMIN.", err)
+		}
+		return nil, nil, err
+	}
+	if *flagDnsBind != "" {
+		// Resolution depends on the system resolver sending queries to --dns-bind
+		return []string{am.Host()}, stop, nil
 	}
-	go onCleanupSignalOrDone(ctx.Done(), func() error {
-		stop()
-		return nil
-	})()
 	if ok, _ := am.Exists(); ok {
-		return []string{am.Host()}, nil
+		return []string{am.Host()}, stop, nil
+	}
+	stop()
+	return nil, nil, fmt.Errorf("Could not set up name resolution for %s to %s", *flagHostname, host)
+}
+
+// bindDns binds --dns-bind, unless its sockets were handed off to this process.
+func bindDns(ctx context.Context, packet *os.File, stream *os.File) (net.PacketConn, net.Listener, error) {
+	if packet == nil || stream == nil {
+		return network.ListenDNS(ctx, *flagDnsBind)
+	}
+	defer packet.Close()
+	defer stream.Close()
+	pc, err := net.FilePacketConn(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := net.FileListener(stream)
+	if err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	return pc, l, nil
+}
+
+// startDns answers DNS queries for --hostname with the --bind address on pc and l, bound to --dns-bind.
+func startDns(ctx context.Context, pc net.PacketConn, l net.Listener) error {
+	host, _, err := net.SplitHostPort(*flagBind)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return fmt.Errorf("--dns-bind requires --bind to have an IP address to answer with, not '%s'", *flagBind)
+	}
+	s, err := network.NewDNSServer(*flagHostname, []net.IP{ip}, *flagDnsUpstream)
+	if err != nil {
+		return err
+	}
+	s.ForwardRemote = *flagDnsForwardRemote
+	go func() {
+		if err := s.Serve(ctx, pc, l); err != nil {
+			log.Printf("Could not answer DNS queries on %s: %s\n", *flagDnsBind, err)
+		}
+	}()
+	return nil
+}
+
+// shutdownSignals returns a context done on SIGINT or SIGTERM. The signals are no longer caught
+// once it is done, so a second one exits.
+func shutdownSignals() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-c:
+		case <-ctx.Done():
+		}
+		signal.Stop(c)
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// finishShutdown stops the background work once the requests are finished, and saves what is left
+// before the network changes are undone. A process that handed off doesn't tell systemd that it
+// is stopping, as the new one keeps serving.
+func finishShutdown(handedOff bool, background *sync.WaitGroup, db *LinkDB) {
+	if !handedOff {
+		notify("STOPPING=1")
+	}
+	log.Printf("Shutting down\n")
+	background.Wait()
+	if err := db.SaveClicks(); err != nil {
+		log.Printf("Could not save click counts: %s\n", err)
 	}
-	return nil, fmt.Errorf("Could not set up name resolution for %s to %s", *flagHostname, host)
 }
 
 func mainImpl(argv []string) error {
@@ -126,31 +210,226 @@ func mainImpl(argv []string) error {
 		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	if *flagCleanup {
+		return network.Cleanup()
+	}
+
+	if *flagHelper {
+		return runHelper(func() ([]string, func() error, error) { return autoconfig(0) })
+	}
+
+	// Taken before the helper is started, so it doesn't inherit them
+	handoffFrom := handoffPid()
+	inherited := inheritedSockets()
+	handoffConn, inherited := takeSocket(inherited, "handoff")
+	helperConn, inherited := takeSocket(inherited, "helper")
+	dnsPacket, inherited := takeSocket(inherited, "dns-udp")
+	dnsStream, inherited := takeSocket(inherited, "dns-tcp")
+	handedOffCert, inherited := takeSocket(inherited, "tls")
+	if handoffConn == nil {
+		handoffFrom = 0
+	}
+
+	// Shutting down starts when ctx is done. A second signal exits right away, without waiting for
+	// the requests or undoing the network changes
+	sigCtx, stopSignals := shutdownSignals()
+	defer stopSignals()
+	ctx, cancel := context.WithCancel(sigCtx)
 	defer cancel()
 
-	db := &LinkDB{}
-	if err := db.LoadJson(*flagCache); err != nil {
+	// The network changes are undone last, unless they were handed off
+	handedOff := false
+	var handover *os.File
+	undo := func() error { return nil }
+	defer func() {
+		if !handedOff {
+			if err := undo(); err != nil {
+				log.Printf("Could not undo network configuration: %s\n", err)
+			}
+		}
+		if handover != nil {
+			handover.Close()
+		}
+	}()
+	handoffSockets := []handoffSocket{}
+	hostResolve := []string{}
+	autoconfigure := func() error {
+		hosts, stop, helper, err := setupAutoconfig(helperConn, handoffFrom)
+		if err != nil {
+			return err
+		}
+		hostResolve, undo = hosts, stop
+		if helper != nil {
+			handoffSockets = append(handoffSockets, handoffSocket{"helper", helper.conn})
+		}
+		return nil
+	}
+
+	// Everything needing privileges happens first, so they can be dropped before the rest. When
+	// taking over, the other process still owns the network changes until it has stopped serving.
+	if *flagAuto && handoffFrom == 0 {
+		if err := autoconfigure(); err != nil {
+			return err
+		}
+	}
+
+	if *flagDnsBind != "" {
+		pc, l, err := bindDns(ctx, dnsPacket, dnsStream)
+		if err != nil {
+			return fmt.Errorf("Could not answer DNS queries on %s: %w", *flagDnsBind, err)
+		}
+		if err := startDns(ctx, pc, l); err != nil {
+			return err
+		}
+		handoffSockets = append(handoffSockets, handoffSocket{"dns-udp", pc}, handoffSocket{"dns-tcp", l})
+	}
+
+	listeners, err := bindHttp(ctx, inherited, handedOffCert)
+	if err != nil {
 		return err
 	}
+	handoffSockets = append(handoffSockets, handoffSocket{"http", listeners.Main})
+	if listeners.Redirect != nil {
+		handoffSockets = append(handoffSockets, handoffSocket{"redirect", listeners.Redirect})
+	}
+
+	// Already dropped when taking over
+	if *flagUser != "" && os.Geteuid() == 0 {
+		if err := dropPrivileges(*flagUser); err != nil {
+			return err
+		}
+	}
 
-	if *flagRemote == "" {
+	store, err := newLinkStore(*flagStore, *flagCache)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if handoffConn != nil {
+		// Whatever could fail is checked before telling the other process, which keeps serving if
+		// this one exits instead
+		if _, err := store.Load(); err != nil {
+			return fmt.Errorf("Could not load golinks from %s: %w", store, err)
+		}
+		if *flagAuto {
+			if err := checkAutoconfig(helperConn); err != nil {
+				return err
+			}
+		}
+		// The links are loaded once the other process has saved its changes. It finishes its
+		// requests while this one serves
+		if err := takeOver(handoffConn, handoffFrom); err != nil {
+			return err
+		}
+		go finishTakeOver(handoffConn, handoffFrom)
+		if *flagAuto {
+			if err := autoconfigure(); err != nil {
+				return err
+			}
+		}
+	}
+
+	db := &LinkDB{Store: store, CollisionPolicy: *flagCollisionPolicy}
+	if err := db.Load(); err != nil {
+		return err
+	}
+	background := sync.WaitGroup{}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		db.saveClicksEvery(ctx, clickSaveInterval)
+	}()
+	// The watchdog stops when the links can't be read, e.g. on a deadlock
+	go runWatchdog(ctx, func() { db.Len() })
+
+	sources := []*remoteSource(flagSources)
+	if *flagRemote != "" {
+		spec := fmt.Sprintf("name=%s,url=%s", originRemote, *flagRemote)
+		if *flagRemoteAuth != "" {
+			spec += "," + *flagRemoteAuth
+		}
+		s, err := parseSourceSpec(spec)
+		if err != nil {
+			return fmt.Errorf("Invalid --remote or --remote-auth: %w", err)
+		}
+		sources = append([]*remoteSource{s}, sources...)
+	}
+	if len(sources) == 0 {
 		log.Printf("There is no remote configured; no golinks will be downloaded")
 	} else {
-		runBackgroundUpdate(ctx, db)
+		rs, err := newRemoteSet(db, sources)
+		if err != nil {
+			return err
+		}
+		rs.Run(ctx)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			rs.Wait()
+		}()
+	}
+
+	if *flagCheckInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			newLinkChecker(db, *flagCheckInterval, *flagCheckRate, *flagCheckConcurrency, *flagCheckTimeout).Run(ctx)
+		}()
 	}
 
 	if *flagChain == "" {
 		log.Printf("There is no chain configured; no redirection will occur on missing links")
 	}
 
-	hostResolve := []string{}
-	if *flagAuto {
-		hostResolve, err = setupAutoconfig(ctx)
-		if err != nil {
-			return err
+	served := make(chan error, 1)
+	go func() { served <- serveHttp(ctx, db, listeners, hostResolve) }()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+wait:
+	for {
+		select {
+		case err = <-served:
+			// Serving failed
+			break wait
+		case <-ctx.Done():
+			err = <-served
+			break wait
+		case <-hup:
+			notify("RELOADING=1")
+			sockets := slices.Clip(handoffSockets)
+			if listeners.TLS != nil {
+				// The new process may not be able to read the certificate's files, e.g. with --user
+				if f, err := certPipe(listeners.TLS.Certificates[0]); err == nil {
+					sockets = append(sockets, handoffSocket{"tls", f})
+				} else {
+					log.Printf("Could not hand off the certificate: %s\n", err)
+				}
+			}
+			f, herr := handOff(sockets)
+			if herr != nil {
+				log.Printf("Could not hand off: %s\n", herr)
+				notify("READY=1")
+				continue
+			}
+			handover, handedOff = f, true
+			// The new process serves once this one has stopped accepting connections and changing
+			// the links, while this one finishes its requests
+			cancel()
+			background.Wait()
+			if err := handOverLinks(handover, db); err != nil {
+				log.Printf("Could not hand over the golinks: %s\n", err)
+			}
+			err = <-served
+			break wait
 		}
 	}
 
-	return serveHttp(ctx, db, hostResolve)
+	cancel()
+	finishShutdown(handedOff, &background, db)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownSignals(t *testing.T) {
+	if os.Getenv("GOHOME_TEST_SHUTDOWN_SIGNALS") == "1" {
+		ctx, stop := shutdownSignals()
+		defer stop()
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		<-ctx.Done()
+		// Exits the process
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		time.Sleep(5 * time.Second)
+		os.Exit(0)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShutdownSignals$")
+	cmd.Env = append(os.Environ(), "GOHOME_TEST_SHUTDOWN_SIGNALS=1")
+	err := cmd.Run()
+	ee := (*exec.ExitError)(nil)
+	if !errors.As(err, &ee) || ee.Sys().(syscall.WaitStatus).Signal() != syscall.SIGINT {
+		t.Errorf("Process after a second SIGINT = %v, want it killed by SIGINT", err)
+	}
+}
+
+func TestFinishShutdown(t *testing.T) {
+	for _, handedOff := range []bool{false, true} {
+		conn := fakeNotifySocket(t)
+		background := sync.WaitGroup{}
+		background.Add(1)
+		finished := false
+		go func() {
+			defer background.Done()
+			time.Sleep(10 * time.Millisecond)
+			finished = true
+		}()
+		finishShutdown(handedOff, &background, &LinkDB{})
+		if !finished {
+			t.Errorf("finishShutdown(%v) returned before the background work finished", handedOff)
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if !handedOff && (err != nil || string(buf[:n]) != "STOPPING=1") {
+			t.Errorf("finishShutdown(false) notified %q, %v, want %q", buf[:n], err, "STOPPING=1")
+		}
+		if handedOff && err == nil {
+			t.Errorf("finishShutdown(true) notified %q, want nothing as the new process keeps serving", buf[:n])
+		}
+	}
+}
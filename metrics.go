@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request outcomes, used as the outcome label of request metrics.
+const (
+	outcomeFound    = "found"     // Redirected to (or previewed) a link
+	outcomeChained  = "chained"   // Redirected to --chain
+	outcomeNotFound = "not_found" // 404 without suggestions
+	outcomeFuzzy404 = "fuzzy_404" // 404 with fuzzy suggestions
+	outcomeReserved = "reserved"  // 404 for a reserved path like favicon.ico
+	outcomePage     = "page"      // Any other page
+	outcomeApi      = "api"
+	outcomeError    = "error" // The handler returned an error
+)
+
+// labeledValues holds a value per label value.
+type labeledValues struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (v *labeledValues) Add(label string, delta float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.values == nil {
+		v.values = map[string]float64{}
+	}
+	v.values[label] += delta
+}
+
+func (v *labeledValues) Set(label string, value float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.values == nil {
+		v.values = map[string]float64{}
+	}
+	v.values[label] = value
+}
+
+func (v *labeledValues) snapshot() map[string]float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return maps.Clone(v.values)
+}
+
+// histogram counts observations into cumulative buckets per label value.
+type histogram struct {
+	Buckets []float64
+
+	mu     sync.Mutex
+	counts map[string][]uint64 // Per bucket, plus one for +Inf
+	sums   map[string]float64
+}
+
+func (h *histogram) Observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = map[string][]uint64{}
+		h.sums = map[string]float64{}
+	}
+	c, ok := h.counts[label]
+	if !ok {
+		c = make([]uint64, len(h.Buckets)+1)
+		h.counts[label] = c
+	}
+	i, _ := slices.BinarySearch(h.Buckets, v)
+	c[i]++
+	h.sums[label] += v
+}
+
+// gohomeMetrics are the metrics served at /_/metrics.
+type gohomeMetrics struct {
+	Requests        labeledValues // By outcome
+	RequestDuration histogram     // By outcome
+	SyncSuccess     labeledValues // Unix time of the last successful sync, by source
+	SyncFailures    labeledValues // By source
+	CacheWriteErrs  labeledValues
+}
+
+var metrics = newGohomeMetrics()
+
+func newGohomeMetrics() *gohomeMetrics {
+	return &gohomeMetrics{
+		RequestDuration: histogram{Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}},
+	}
+}
+
+func (m *gohomeMetrics) ObserveRequest(outcome string, d time.Duration) {
+	m.Requests.Add(outcome, 1)
+	m.RequestDuration.Observe(outcome, d.Seconds())
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writeLabeled writes a metric family with one label in the Prometheus text format.
+func writeLabeled(w io.Writer, name string, typ string, help string, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, k := range slices.Sorted(maps.Keys(values)) {
+		if label == "" {
+			fmt.Fprintf(w, "%s %s\n", name, formatFloat(values[k]))
+			continue
+		}
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, label, escapeLabel(k), formatFloat(values[k]))
+	}
+}
+
+func (h *histogram) write(w io.Writer, name string, help string, label string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, k := range slices.Sorted(maps.Keys(h.counts)) {
+		lv := fmt.Sprintf("%s=\"%s\"", label, escapeLabel(k))
+		var cum uint64
+		for i, c := range h.counts[k] {
+			cum += c
+			le := "+Inf"
+			if i < len(h.Buckets) {
+				le = formatFloat(h.Buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, lv, le, cum)
+		}
+		fmt.Fprintf(w, "%s_sum{%s} %s\n%s_count{%s} %d\n", name, lv, formatFloat(h.sums[k]), name, lv, cum)
+	}
+}
+
+// Write writes every metric in the Prometheus text exposition format.
+func (m *gohomeMetrics) Write(w io.Writer, db *LinkDB) {
+	writeLabeled(w, "gohome_requests_total", "counter", "HTTP requests handled, by outcome.", "outcome", m.Requests.snapshot())
+	m.RequestDuration.write(w, "gohome_request_duration_seconds", "Time to handle HTTP requests, by outcome.", "outcome")
+	writeLabeled(w, "gohome_links", "gauge", "Number of links in the database.", "", map[string]float64{"": float64(db.Len())})
+	writeLabeled(w, "gohome_remote_last_success_timestamp_seconds", "gauge", "Unix time of the last successful sync, by source.", "source", m.SyncSuccess.snapshot())
+	writeLabeled(w, "gohome_remote_sync_failures_total", "counter", "Failed syncs, by source.", "source", m.SyncFailures.snapshot())
+	writeLabeled(w, "gohome_cache_write_errors_total", "counter", "Failed writes to the link store.", "", map[string]float64{"": m.CacheWriteErrs.snapshot()[""]})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics = newGohomeMetrics()
+	*flagChain = ""
+	db := &LinkDB{}
+	db.Update([]Link{{Display: "foo", Destination: "http://example.org"}})
+
+	for _, path := range []string{"/foo", "/foo/bar", "/fo", "/zzzzzzzzzz", "/favicon.ico", "/_/view"} {
+		g := goHttp{W: httptest.NewRecorder(), R: httptest.NewRequest("GET", path, nil), Outcome: outcomePage}
+		if err := g.route(db); err != nil {
+			t.Fatal(err)
+		}
+		metrics.ObserveRequest(g.Outcome, 0)
+	}
+	metrics.SyncFailures.Add("remote", 1)
+
+	rr := httptest.NewRecorder()
+	g := goHttp{W: rr, R: httptest.NewRequest("GET", "/_/metrics", nil)}
+	if err := g.route(db); err != nil {
+		t.Fatal(err)
+	}
+	out := rr.Body.String()
+	for _, want := range []string{
+		`gohome_requests_total{outcome="found"} 2`,
+		`gohome_requests_total{outcome="fuzzy_404"} 1`,
+		`gohome_requests_total{outcome="not_found"} 1`,
+		`gohome_requests_total{outcome="reserved"} 1`,
+		`gohome_requests_total{outcome="page"} 1`,
+		`gohome_request_duration_seconds_bucket{outcome="found",le="0.0005"} 2`,
+		`gohome_request_duration_seconds_count{outcome="found"} 2`,
+		"gohome_links 1\n",
+		`gohome_remote_sync_failures_total{source="remote"} 1`,
+		"gohome_cache_write_errors_total 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("/_/metrics does not contain %q", want)
+		}
+	}
+}
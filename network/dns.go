@@ -0,0 +1,360 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTTL         = 60
+	dnsMaxUdpSize  = 512 // Without EDNS(0)
+	dnsMaxTcpSize  = 65535
+	dnsTimeout     = 5 * time.Second
+	dnsIdleTimeout = 30 * time.Second
+	dnsMaxQueries  = 128 // Answered or forwarded at once
+	dnsMaxConns    = 128 // Open TCP connections
+)
+
+// DNSServer answers A and AAAA queries for a single hostname, so a resolver like systemd-resolved
+// or dnsmasq may send that name to it with a split DNS rule instead of editing /etc/hosts.
+// Other names under the hostname don't exist. Queries for any other name are forwarded to
+// Upstream, or refused if it is empty. Unless ForwardRemote is set, only queries from loopback
+// addresses are forwarded so the server can't be used as an open resolver. Create it with
+// NewDNSServer.
+type DNSServer struct {
+	Host          string   // Without the trailing dot
+	IPs           []net.IP // The addresses answered for Host
+	Upstream      string   // host:port of a DNS server
+	ForwardRemote bool     // Forward queries from clients that aren't on a loopback address
+	Timeout       time.Duration
+
+	queries chan struct{} // Holds a value for each query being answered
+	conns   chan struct{} // Holds a value for each open TCP connection
+}
+
+func NewDNSServer(host string, ips []net.IP, upstream string) (*DNSServer, error) {
+	host = strings.TrimSuffix(host, ".")
+	if !validDNSName(host) {
+		return nil, fmt.Errorf("Invalid DNS name '%s'", host)
+	}
+	if upstream != "" {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+	}
+	return &DNSServer{
+		Host:     host,
+		IPs:      ips,
+		Upstream: upstream,
+		Timeout:  dnsTimeout,
+		queries:  make(chan struct{}, dnsMaxQueries),
+		conns:    make(chan struct{}, dnsMaxConns),
+	}, nil
+}
+
+func validDNSName(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// ListenAndServe answers queries over UDP and TCP on addr until ctx is done.
+func (s *DNSServer) ListenAndServe(ctx context.Context, addr string) error {
+	pc, l, err := ListenDNS(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, pc, l)
+}
+
+// ListenDNS binds addr over UDP and TCP. Binding before serving allows privileges to be dropped
+// in between.
+func ListenDNS(ctx context.Context, addr string) (net.PacketConn, net.Listener, error) {
+	lc := net.ListenConfig{}
+	pc, err := lc.ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := lc.Listen(ctx, "tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	return pc, l, nil
+}
+
+// Serve answers queries on pc and l until ctx is done, closing them.
+func (s *DNSServer) Serve(ctx context.Context, pc net.PacketConn, l net.Listener) error {
+	log.Printf("Answering DNS queries for %s on %s\n", s.Host, pc.LocalAddr())
+	// Stop both if either fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, 2)
+	go func() { errs <- s.ServePacket(ctx, pc); cancel() }()
+	go func() { errs <- s.ServeStream(ctx, l); cancel() }()
+	return errors.Join(<-errs, <-errs)
+}
+
+// ServePacket answers queries received on pc until ctx is done, closing pc.
+func (s *DNSServer) ServePacket(ctx context.Context, pc net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+	buf := make([]byte, dnsMaxTcpSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		query := append([]byte{}, buf[:n]...)
+		// Wait for a query to finish rather than reading more; the kernel drops what doesn't fit
+		select {
+		case s.queries <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		go func() {
+			defer func() { <-s.queries }()
+			resp := s.Answer(ctx, query, addr)
+			if resp == nil {
+				return
+			}
+			if _, err := pc.WriteTo(resp, addr); err != nil && ctx.Err() == nil {
+				log.Printf("Could not send DNS response to %s: %s\n", addr, err)
+			}
+		}()
+	}
+}
+
+// ServeStream answers queries on connections accepted from l until ctx is done, closing l.
+func (s *DNSServer) ServeStream(ctx context.Context, l net.Listener) error {
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case s.conns <- struct{}{}:
+		default:
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-s.conns }()
+			defer conn.Close()
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			for {
+				conn.SetDeadline(time.Now().Add(dnsIdleTimeout))
+				query, err := readStreamMessage(conn)
+				if err != nil {
+					return
+				}
+				select {
+				case s.queries <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				resp := s.Answer(ctx, query, conn.RemoteAddr())
+				<-s.queries
+				if resp == nil {
+					return
+				}
+				if err := writeStreamMessage(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Answer returns the response to the query received from the UDP or TCP address from, or nil if
+// the query is too malformed to respond to.
+func (s *DNSServer) Answer(ctx context.Context, query []byte, from net.Addr) []byte {
+	p := dnsmessage.Parser{}
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil || len(questions) != 1 || h.OpCode != 0 {
+		rcode := dnsmessage.RCodeFormatError
+		if err == nil && h.OpCode != 0 {
+			rcode = dnsmessage.RCodeNotImplemented
+		}
+		return s.response(h, questions, rcode, nil, false)
+	}
+	q := questions[0]
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	switch {
+	case strings.EqualFold(name, s.Host):
+		return s.response(h, questions, dnsmessage.RCodeSuccess, s.answers(q), true)
+	case strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(s.Host)):
+		return s.response(h, questions, dnsmessage.RCodeNameError, nil, true)
+	case s.Upstream != "" && (s.ForwardRemote || isLoopback(from)):
+		resp, err := s.forward(ctx, query, from.Network())
+		if err != nil {
+			log.Printf("Could not forward DNS query for %s to %s: %s\n", name, s.Upstream, err)
+			return s.response(h, questions, dnsmessage.RCodeServerFailure, nil, false)
+		}
+		return resp
+	default:
+		return s.response(h, questions, dnsmessage.RCodeRefused, nil, false)
+	}
+}
+
+func isLoopback(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.IsLoopback()
+	case *net.TCPAddr:
+		return a.IP.IsLoopback()
+	}
+	return false
+}
+
+// answers returns the records of s.IPs matching the question's type.
+func (s *DNSServer) answers(q dnsmessage.Question) []dnsmessage.Resource {
+	rs := []dnsmessage.Resource{}
+	for _, ip := range s.IPs {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		ip4 := ip.To4()
+		switch {
+		case q.Type == dnsmessage.TypeA && ip4 != nil:
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			rs = append(rs, dnsmessage.Resource{Header: rh, Body: r})
+		case q.Type == dnsmessage.TypeAAAA && ip4 == nil && ip.To16() != nil:
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip.To16())
+			rs = append(rs, dnsmessage.Resource{Header: rh, Body: r})
+		}
+	}
+	return rs
+}
+
+func (s *DNSServer) response(qh dnsmessage.Header, questions []dnsmessage.Question, rcode dnsmessage.RCode, answers []dnsmessage.Resource, authoritative bool) []byte {
+	h := dnsmessage.Header{
+		ID:                 qh.ID,
+		Response:           true,
+		OpCode:             qh.OpCode,
+		Authoritative:      authoritative,
+		RecursionDesired:   qh.RecursionDesired,
+		RecursionAvailable: s.Upstream != "",
+		RCode:              rcode,
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 0, dnsMaxUdpSize), h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return nil
+		}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil
+	}
+	for _, a := range answers {
+		var err error
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			err = b.AResource(a.Header, *body)
+		case *dnsmessage.AAAAResource:
+			err = b.AAAAResource(a.Header, *body)
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// forward sends the query to Upstream over the same network it was received on and returns the response.
+func (s *DNSServer) forward(ctx context.Context, query []byte, network string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, s.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if network == "tcp" {
+		if err := writeStreamMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readStreamMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxTcpSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray responses to other queries
+		if n >= 2 && binary.BigEndian.Uint16(buf) == binary.BigEndian.Uint16(query) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// readStreamMessage reads a message prefixed by its length, as DNS messages are sent over TCP.
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeStreamMessage(w io.Writer, msg []byte) error {
+	if len(msg) > dnsMaxTcpSize {
+		return fmt.Errorf("DNS message of %d bytes is too long", len(msg))
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
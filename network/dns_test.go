@@ -0,0 +1,239 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startDNS serves s on a free local port, returning the address.
+func startDNS(t *testing.T, s *DNSServer) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{}, 2)
+	go func() { s.ServePacket(ctx, pc); done <- struct{}{} }()
+	go func() { s.ServeStream(ctx, l); done <- struct{}{} }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		<-done
+	})
+	return pc.LocalAddr().String()
+}
+
+// resolver returns a resolver that only asks the DNS server at addr, over TCP if tcp is set.
+func resolver(addr string, tcp bool) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if tcp {
+				network = "tcp"
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func TestDNSServer(t *testing.T) {
+	upstream, err := NewDNSServer("example.org", []net.IP{net.ParseIP("192.0.2.1")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamAddr := startDNS(t, upstream)
+
+	ips := []net.IP{net.ParseIP("127.0.0.53"), net.ParseIP("fd00::53")}
+	forwarding, err := NewDNSServer("gohome.", ips, upstreamAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusing, err := NewDNSServer("gohome", ips, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := map[string]string{"forwarding": startDNS(t, forwarding), "refusing": startDNS(t, refusing)}
+
+	tests := []struct {
+		server  string
+		network string // The resolver's "ip", "ip4" or "ip6"
+		host    string
+		want    []string // nil if the lookup fails
+	}{
+		{"forwarding", "ip4", "gohome", []string{"127.0.0.53"}},
+		{"forwarding", "ip6", "gohome", []string{"fd00::53"}},
+		{"forwarding", "ip", "GoHome.", []string{"127.0.0.53", "fd00::53"}},
+		{"forwarding", "ip4", "www.gohome", nil},
+		{"forwarding", "ip4", "example.org", []string{"192.0.2.1"}},
+		{"forwarding", "ip6", "example.org", []string{}},
+		{"forwarding", "ip4", "example.com", nil}, // Refused by the upstream
+		{"refusing", "ip4", "gohome", []string{"127.0.0.53"}},
+		{"refusing", "ip4", "example.org", nil},
+	}
+	for _, tcp := range []bool{false, true} {
+		for _, tc := range tests {
+			r := resolver(servers[tc.server], tcp)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			addrs, err := r.LookupIP(ctx, tc.network, tc.host)
+			cancel()
+			got := []string{}
+			for _, a := range addrs {
+				got = append(got, a.String())
+			}
+			slices.Sort(got)
+			dnsErr := &net.DNSError{}
+			switch {
+			case tc.want == nil && err == nil:
+				t.Errorf("%s (tcp=%v): LookupIP(%s, %s) = %v, want an error", tc.server, tcp, tc.network, tc.host, got)
+			case tc.want == nil:
+			case len(tc.want) == 0 && errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+				// No addresses of the type
+			case err != nil:
+				t.Errorf("%s (tcp=%v): LookupIP(%s, %s) failed: %s", tc.server, tcp, tc.network, tc.host, err)
+			case !slices.Equal(got, tc.want):
+				t.Errorf("%s (tcp=%v): LookupIP(%s, %s) = %v, want %v", tc.server, tcp, tc.network, tc.host, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestDNSServerNotFound(t *testing.T) {
+	s, err := NewDNSServer("gohome", []net.IP{net.ParseIP("127.0.0.53")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := resolver(startDNS(t, s), false)
+	_, err = r.LookupIP(context.Background(), "ip4", "www.gohome")
+	dnsErr := &net.DNSError{}
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupIP(www.gohome) = %v, want not found", err)
+	}
+	_, err = r.LookupIP(context.Background(), "ip4", "example.org")
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+		t.Errorf("LookupIP(example.org) = %v, want refused", err)
+	}
+}
+
+func TestNewDNSServer(t *testing.T) {
+	tests := []struct {
+		host     string
+		upstream string
+		want     string // Upstream, or "error"
+	}{
+		{"gohome", "", ""},
+		{"gohome", "192.0.2.1", "192.0.2.1:53"},
+		{"gohome", "192.0.2.1:5353", "192.0.2.1:5353"},
+		{"gohome", "2001:db8::1", "[2001:db8::1]:53"},
+		{"", "", "error"},
+		{"go..home", "", "error"},
+	}
+	for _, tc := range tests {
+		s, err := NewDNSServer(tc.host, nil, tc.upstream)
+		got := "error"
+		if err == nil {
+			got = s.Upstream
+		}
+		if got != tc.want {
+			t.Errorf("NewDNSServer(%q, %q).Upstream = %q, want %q", tc.host, tc.upstream, got, tc.want)
+		}
+	}
+}
+
+// dnsQuery returns a query for the A records of name.
+func dnsQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestDNSServerForwardRemote(t *testing.T) {
+	upstream, err := NewDNSServer("example.org", []net.IP{net.ParseIP("192.0.2.1")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDNSServer("gohome", []net.IP{net.ParseIP("127.0.0.53")}, startDNS(t, upstream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from          net.Addr
+		forwardRemote bool
+		want          dnsmessage.RCode
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1053}, false, dnsmessage.RCodeSuccess},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1053}, false, dnsmessage.RCodeSuccess},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1053}, false, dnsmessage.RCodeRefused},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1053}, false, dnsmessage.RCodeRefused},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1053}, true, dnsmessage.RCodeSuccess},
+	}
+	for _, tc := range tests {
+		s.ForwardRemote = tc.forwardRemote
+		p := dnsmessage.Parser{}
+		h, err := p.Start(s.Answer(context.Background(), dnsQuery(t, 1, "example.org."), tc.from))
+		if err != nil || h.RCode != tc.want {
+			t.Errorf("Answer() from %s with ForwardRemote %v = %v, %v, want %v", tc.from, tc.forwardRemote, h.RCode, err, tc.want)
+		}
+		// The hostname is always answered
+		h, err = p.Start(s.Answer(context.Background(), dnsQuery(t, 2, "gohome."), tc.from))
+		if err != nil || h.RCode != dnsmessage.RCodeSuccess {
+			t.Errorf("Answer() for gohome from %s = %v, %v, want success", tc.from, h.RCode, err)
+		}
+	}
+}
+
+func TestDNSServerLimitsQueries(t *testing.T) {
+	// An upstream that never answers holds forwarded queries until they time out
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	s, err := NewDNSServer("gohome", []net.IP{net.ParseIP("127.0.0.53")}, upstream.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Timeout = time.Second
+	s.queries = make(chan struct{}, 2)
+	conn, err := net.Dial("udp", startDNS(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := range 2 {
+		conn.Write(dnsQuery(t, uint16(i), "example.org."))
+	}
+	start := time.Now()
+	conn.Write(dnsQuery(t, 100, "gohome."))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, dnsMaxUdpSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := dnsmessage.Parser{}
+		if h, err := p.Start(buf[:n]); err == nil && h.ID == 100 {
+			break
+		}
+	}
+	if d := time.Since(start); d < s.Timeout/2 {
+		t.Errorf("Answered a query after %s with 2 of 2 queries in flight, want it to wait for one to time out", d)
+	}
+}
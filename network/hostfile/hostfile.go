@@ -1,103 +1,303 @@
 package hostfile
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"slices"
 	"strings"
+	"unicode"
 
 	"github.com/google/renameio/v2"
 )
 
-type Hostfile struct {
-	Filename string
+// Everything added to a hosts file is recorded in a block between these lines, so that it can be
+// removed again without touching anything else.
+const (
+	blockBegin = "# BEGIN gohome"
+	blockEnd   = "# END gohome"
+	// Records a host added as an alias to an existing line: "# alias <ip> <host>"
+	aliasRecord = "# alias "
+)
+
+// Entry maps an IP address to hostnames.
+type Entry struct {
+	IP      net.IP
+	Hosts   []string // The canonical hostname, then any aliases
+	Comment string   // The text after '#', if any
 }
 
-func (eh *Hostfile) HostExists(ip string) (bool, error) {
-	// We should probably do this right by parsing the file, but this works (unless the IP is in a comment)
-	d, err := os.ReadFile(eh.Filename)
-	if err != nil {
-		return false, err
-	}
-	if bytes.Contains(d, []byte(ip)) {
-		return true, nil
+// Line is a line of a hosts file. Blank, comment and invalid lines have no Entry.
+type Line struct {
+	Raw   string // Without the line ending
+	EOL   string // "\n", "\r\n", or "" for a last line without one
+	Entry *Entry
+}
+
+// File is a parsed hosts file. Lines that aren't changed are written back exactly as read.
+type File struct {
+	Lines []Line
+}
+
+// Parse parses a hosts file. It never fails; lines that aren't valid entries are kept as is.
+func Parse(b []byte) *File {
+	f := &File{}
+	for _, raw := range strings.SplitAfter(string(b), "\n") {
+		if raw == "" {
+			continue
+		}
+		l := Line{}
+		l.Raw, l.EOL = strings.TrimSuffix(raw, "\n"), ""
+		if len(l.Raw) < len(raw) {
+			l.EOL = "\n"
+			if strings.HasSuffix(l.Raw, "\r") {
+				l.Raw, l.EOL = strings.TrimSuffix(l.Raw, "\r"), "\r\n"
+			}
+		}
+		l.Entry = parseEntry(l.Raw)
+		f.Lines = append(f.Lines, l)
 	}
-	return false, nil
+	return f
 }
 
-func (eh *Hostfile) AddHost(e *HostEntry, comment string) error {
-	ip := e.IP.String()
-	log.Printf("Adding hosts entry %s %s", ip, e.Host)
-	// We can't add an IP twice, so we check the lines ahead of time and bail if that would happen.
-	he, err := eh.HostExists(ip)
-	if err != nil {
-		return err
+func parseEntry(raw string) *Entry {
+	data, comment, _ := strings.Cut(raw, "#")
+	fields := strings.Fields(data)
+	if len(fields) < 2 {
+		return nil
 	}
-	if he {
-		return fmt.Errorf("%s already contains the IP address %s", eh.Filename, ip)
+	// Link-local IPv6 addresses may have a zone, e.g. fe80::1%lo0
+	addr, _, _ := strings.Cut(fields[0], "%")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
 	}
-	err = editFileLines(eh.Filename, []string{fmt.Sprintf("\n%s %s # %s", e.IP.String(), e.Host, comment)}, func(s string) bool { return false })
-	if err != nil {
-		return err
+	return &Entry{ip, fields[1:], strings.TrimSpace(comment)}
+}
+
+// Bytes returns the contents of the file.
+func (f *File) Bytes() []byte {
+	b := strings.Builder{}
+	for _, l := range f.Lines {
+		b.WriteString(l.Raw)
+		b.WriteString(l.EOL)
 	}
-	return nil
+	return []byte(b.String())
 }
 
-func editFileLines(filename string, appendLines []string, removeLineFunc func(line string) bool) error {
-	// We'd like to keep comments, so we edit line by line
+// Lookup returns the addresses of host, in the order of the file.
+func (f *File) Lookup(host string) []net.IP {
+	ips := []net.IP{}
+	for _, l := range f.Lines {
+		if l.Entry != nil && slices.ContainsFunc(l.Entry.Hosts, func(h string) bool { return strings.EqualFold(h, host) }) {
+			ips = append(ips, l.Entry.IP)
+		}
+	}
+	return ips
+}
+
+// HasIP reports whether any entry is for ip.
+func (f *File) HasIP(ip net.IP) bool {
+	return slices.ContainsFunc(f.Lines, func(l Line) bool { return l.Entry != nil && l.Entry.IP.Equal(ip) })
+}
+
+// block returns the indices of the begin and end lines of the block of added entries, or -1, -1
+// if there is none.
+func (f *File) block() (int, int, error) {
+	begin := slices.IndexFunc(f.Lines, func(l Line) bool { return l.Raw == blockBegin || strings.HasPrefix(l.Raw, blockBegin+" ") })
+	if begin < 0 {
+		return -1, -1, nil
+	}
+	end := slices.IndexFunc(f.Lines[begin:], func(l Line) bool { return strings.TrimSpace(l.Raw) == blockEnd })
+	if end < 0 {
+		return -1, -1, fmt.Errorf("Found '%s' without '%s'", blockBegin, blockEnd)
+	}
+	return begin, begin + end, nil
+}
 
-	file, err := os.Open(filename)
+// Add makes host resolve to ip, recording the change so that Remove can undo it. If there is an
+// entry for ip host is added to it as an alias, otherwise a new entry is added. Nothing is changed
+// if host already resolves to ip. The description is added to the beginning of the block of
+// changes when it is created.
+func (f *File) Add(ip net.IP, host string, description string) error {
+	begin, end, err := f.block()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	linebuf := []string{}
+	for i, l := range f.Lines {
+		if l.Entry == nil || !slices.ContainsFunc(l.Entry.Hosts, func(h string) bool { return strings.EqualFold(h, host) }) {
+			continue
+		}
+		if l.Entry.IP.Equal(ip) {
+			return nil
+		}
+		if i < begin || i > end {
+			return fmt.Errorf("%s is already an entry for %s", host, l.Entry.IP)
+		}
+	}
+	// Left over from a previous run with another address
+	f.Remove(nil, host)
+	begin, end, _ = f.block()
 
-	scanner := bufio.NewScanner(file)
+	record := Line{Raw: fmt.Sprintf("%s %s", ip, host), EOL: "\n"}
+	if i := slices.IndexFunc(f.Lines, func(l Line) bool { return l.Entry != nil && l.Entry.IP.Equal(ip) }); i >= 0 && (i < begin || i > end) {
+		f.Lines[i].addHost(host)
+		record.Raw = aliasRecord + record.Raw
+	}
+	record.Entry = parseEntry(record.Raw)
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !removeLineFunc(line) {
-			linebuf = append(linebuf, line)
+	if begin < 0 {
+		bl := Line{Raw: blockBegin, EOL: "\n"}
+		if description != "" {
+			bl.Raw += " (" + description + ")"
 		}
+		el := Line{Raw: blockEnd, EOL: "\n"}
+		if n := len(f.Lines); n > 0 && f.Lines[n-1].EOL == "" {
+			// Keep the file without a final line ending, so it is restored exactly when removed
+			f.Lines[n-1].EOL, el.EOL = "\n", ""
+		}
+		f.Lines = append(f.Lines, bl, el)
+		end = len(f.Lines) - 1
 	}
+	f.Lines = slices.Insert(f.Lines, end, record)
+	return nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return err
+// Remove undoes what Add recorded for host, and ip if it isn't nil, returning whether anything
+// was removed. The block of changes is removed once it is empty.
+func (f *File) Remove(ip net.IP, host string) bool {
+	begin, end, err := f.block()
+	if err != nil || begin < 0 {
+		return false
 	}
+	removed := false
+	for i := end - 1; i > begin; i-- {
+		raw, isAlias := strings.CutPrefix(f.Lines[i].Raw, aliasRecord)
+		e := parseEntry(raw)
+		if e == nil || len(e.Hosts) != 1 || !strings.EqualFold(e.Hosts[0], host) || ip != nil && !e.IP.Equal(ip) {
+			continue
+		}
+		if isAlias {
+			for j := range f.Lines {
+				if (j < begin || j > end) && f.Lines[j].Entry != nil && f.Lines[j].Entry.IP.Equal(e.IP) {
+					f.Lines[j].removeHost(e.Hosts[0])
+				}
+			}
+		}
+		f.Lines = slices.Delete(f.Lines, i, i+1)
+		end--
+		removed = true
+	}
+	if end == begin+1 {
+		if f.Lines[end].EOL == "" && begin > 0 {
+			f.Lines[begin-1].EOL = ""
+		}
+		f.Lines = slices.Delete(f.Lines, begin, end+1)
+	}
+	return removed
+}
+
+// dataEnd returns the length of the entry's data, without its comment and the space before it.
+func (l *Line) dataEnd() int {
+	data, _, _ := strings.Cut(l.Raw, "#")
+	return len(strings.TrimRightFunc(data, unicode.IsSpace))
+}
+
+// addHost adds host to the end of the line's hostnames, keeping its comment.
+func (l *Line) addHost(host string) {
+	n := l.dataEnd()
+	l.Raw = l.Raw[:n] + " " + host + l.Raw[n:]
+	l.Entry = parseEntry(l.Raw)
+}
 
-	linebuf = append(linebuf, appendLines...)
+// removeHost removes host and the space before it from the line's aliases. The first hostname
+// is never removed, as the line would no longer be an entry.
+func (l *Line) removeHost(host string) {
+	n := l.dataEnd()
+	// Find each field with the space before it
+	fields := 0
+	for i := 0; i < n; {
+		start := i
+		for i < n && unicode.IsSpace(rune(l.Raw[i])) {
+			i++
+		}
+		fieldStart := i
+		for i < n && !unicode.IsSpace(rune(l.Raw[i])) {
+			i++
+		}
+		fields++
+		if fields > 2 && l.Raw[fieldStart:i] == host {
+			l.Raw = l.Raw[:start] + l.Raw[i:]
+			l.Entry = parseEntry(l.Raw)
+			return
+		}
+	}
+}
 
-	file.Close()
+// Hostfile is a hosts file on disk, usually /etc/hosts.
+type Hostfile struct {
+	Filename string
+}
 
-	sbuf := strings.Join(linebuf, "\n")
+func (eh *Hostfile) read() (*File, error) {
+	d, err := os.ReadFile(eh.Filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(d), nil
+}
 
+func (eh *Hostfile) write(f *File) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(eh.Filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
 	// Use an atomic write - a torn /etc/hosts is bad(tm)
-	return renameio.WriteFile(filename, []byte(sbuf), 0644)
+	return renameio.WriteFile(eh.Filename, f.Bytes(), mode)
+}
+
+// HostExists reports whether the file has an entry for ip.
+func (eh *Hostfile) HostExists(ip string) (bool, error) {
+	nip := net.ParseIP(ip)
+	if nip == nil {
+		return false, fmt.Errorf("Invalid IP address %s", ip)
+	}
+	f, err := eh.read()
+	if err != nil {
+		return false, err
+	}
+	return f.HasIP(nip), nil
+}
+
+// AddHost adds e to the file as described by File.Add.
+func (eh *Hostfile) AddHost(e *HostEntry, comment string) error {
+	log.Printf("Adding hosts entry %s %s", e.IP, e.Host)
+	f, err := eh.read()
+	if err != nil {
+		return err
+	}
+	before := f.Bytes()
+	if err := f.Add(e.IP, e.Host, comment); err != nil {
+		return fmt.Errorf("Could not add %s to %s: %w", e.Host, eh.Filename, err)
+	}
+	if string(f.Bytes()) == string(before) {
+		return nil
+	}
+	return eh.write(f)
 }
 
+// RemoveHost removes e if it was added by AddHost, returning whether it was.
 func (eh *Hostfile) RemoveHost(e *HostEntry) (bool, error) {
 	log.Printf("Removing hosts entry %s %s", e.IP, e.Host)
-	removed := false
-	return removed, editFileLines(eh.Filename, []string{}, func(line string) bool {
-		// Be paranoid and make sure we're only removing an ip and host that we expect, and that there's no other hosts here
-		left, _, _ := strings.Cut(line, "#")
-		dataline := strings.TrimSpace(left)
-		f := strings.Fields(dataline)
-		if len(f) == 2 { // Line has only one hostname
-			if f[0] == e.IP.String() { // And our IP
-				if f[1] == e.Host { // That is ours
-					removed = true
-					return true
-				}
-			}
-		}
-		return false
-	})
+	f, err := eh.read()
+	if err != nil {
+		return false, err
+	}
+	if !f.Remove(e.IP, e.Host) {
+		return false, nil
+	}
+	return true, eh.write(f)
 }
 
 type HostEntry struct {
@@ -108,7 +308,7 @@ type HostEntry struct {
 func NewHostEntry(host string, ip string) (*HostEntry, error) {
 	nip := net.ParseIP(ip)
 	if nip == nil {
-		return nil, fmt.Errorf("Invalid IP address %s", nip)
+		return nil, fmt.Errorf("Invalid IP address %s", ip)
 	}
 	return &HostEntry{host, nip}, nil
 }
@@ -0,0 +1,280 @@
+package hostfile
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testHosts = `##
+# Host Database
+#
+# localhost is used to configure the loopback interface
+##
+127.0.0.1	localhost	# the loopback
+255.255.255.255	broadcasthost
+::1             localhost ip6-localhost
+fe80::1%lo0	localhost
+
+# 127.0.0.53 commented
+127.0.0.5 five
+not-an-ip foo
+10.0.0.1
+`
+
+func TestParseRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"\n",
+		testHosts,
+		strings.TrimSuffix(testHosts, "\n"),
+		strings.ReplaceAll(testHosts, "\n", "\r\n"),
+		"127.0.0.1 localhost\r\n10.0.0.1 mixed\n  \t\n# no final newline",
+		"   127.0.0.1    spaced   out  # comment # with hash   \n",
+	}
+	for _, tc := range tests {
+		if got := string(Parse([]byte(tc)).Bytes()); got != tc {
+			t.Errorf("Parse(%q).Bytes() = %q", tc, got)
+		}
+	}
+}
+
+func TestParseEntries(t *testing.T) {
+	f := Parse([]byte(testHosts))
+	got := []string{}
+	for _, l := range f.Lines {
+		if l.Entry == nil {
+			continue
+		}
+		got = append(got, l.Entry.IP.String()+" "+strings.Join(l.Entry.Hosts, ",")+" #"+l.Entry.Comment)
+	}
+	want := []string{
+		"127.0.0.1 localhost #the loopback",
+		"255.255.255.255 broadcasthost #",
+		"::1 localhost,ip6-localhost #",
+		"fe80::1 localhost #",
+		"127.0.0.5 five #",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Parse() entries = %q, want %q", got, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	f := Parse([]byte(testHosts))
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{"localhost", []string{"127.0.0.1", "::1", "fe80::1"}},
+		{"LocalHost", []string{"127.0.0.1", "::1", "fe80::1"}},
+		{"ip6-localhost", []string{"::1"}},
+		{"commented", []string{}},
+		{"foo", []string{}},
+		{"five", []string{"127.0.0.5"}},
+	}
+	for _, tc := range tests {
+		got := []string{}
+		for _, ip := range f.Lookup(tc.host) {
+			got = append(got, ip.String())
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("Lookup(%q) = %q, want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestHasIP(t *testing.T) {
+	f := Parse([]byte(testHosts))
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.0.0.5", true},
+		{"127.0.0.53", false}, // Only in a comment, and 127.0.0.5 is a prefix
+		{"::1", true},
+		{"0:0:0:0:0:0:0:1", true},
+		{"10.0.0.1", false}, // No hostname
+		{"fe80::1", true},
+	}
+	for _, tc := range tests {
+		if got := f.HasIP(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("HasIP(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	ip := net.ParseIP("127.0.0.53")
+	tests := []struct {
+		desc    string
+		hosts   string
+		want    string // After adding gohome
+		removed string // After removing it again, if not hosts
+	}{
+		{
+			"empty",
+			"",
+			"# BEGIN gohome (test)\n127.0.0.53 gohome\n# END gohome\n",
+			"",
+		},
+		{
+			"new entry",
+			"127.0.0.1 localhost\n",
+			"127.0.0.1 localhost\n# BEGIN gohome (test)\n127.0.0.53 gohome\n# END gohome\n",
+			"",
+		},
+		{
+			"no final newline",
+			"127.0.0.1 localhost",
+			"127.0.0.1 localhost\n# BEGIN gohome (test)\n127.0.0.53 gohome\n# END gohome",
+			"",
+		},
+		{
+			"substring of another address",
+			"127.0.0.5 five\n",
+			"127.0.0.5 five\n# BEGIN gohome (test)\n127.0.0.53 gohome\n# END gohome\n",
+			"",
+		},
+		{
+			"alias to existing line",
+			"127.0.0.53\tother  # mine\n::1 localhost\n",
+			"127.0.0.53\tother gohome  # mine\n::1 localhost\n# BEGIN gohome (test)\n# alias 127.0.0.53 gohome\n# END gohome\n",
+			"",
+		},
+		{
+			"alias with CRLF",
+			"127.0.0.53 other\r\n",
+			"127.0.0.53 other gohome\r\n# BEGIN gohome (test)\n# alias 127.0.0.53 gohome\n# END gohome\n",
+			"",
+		},
+		{
+			"already resolves",
+			"127.0.0.53 GoHome\n",
+			"127.0.0.53 GoHome\n",
+			"",
+		},
+		{
+			"existing block",
+			"# BEGIN gohome (test)\n127.0.0.53 other\n# END gohome\n",
+			"# BEGIN gohome (test)\n127.0.0.53 other\n127.0.0.53 gohome\n# END gohome\n",
+			"",
+		},
+		{
+			"stale entry with another address",
+			"1.1.1.1 x\n# BEGIN gohome (test)\n127.0.0.54 gohome\n# END gohome\n",
+			"1.1.1.1 x\n# BEGIN gohome (test)\n127.0.0.53 gohome\n# END gohome\n",
+			"1.1.1.1 x\n",
+		},
+	}
+	for _, tc := range tests {
+		f := Parse([]byte(tc.hosts))
+		if err := f.Add(ip, "gohome", "test"); err != nil {
+			t.Errorf("%s: Add() failed: %s", tc.desc, err)
+			continue
+		}
+		if got := string(f.Bytes()); got != tc.want {
+			t.Errorf("%s: Add() = %q, want %q", tc.desc, got, tc.want)
+		}
+		if got := f.Lookup("gohome"); len(got) != 1 || !got[0].Equal(ip) {
+			t.Errorf("%s: Lookup(gohome) after Add() = %v, want %s", tc.desc, got, ip)
+		}
+		// Adding again changes nothing
+		f.Add(ip, "gohome", "test")
+		if got := string(f.Bytes()); got != tc.want {
+			t.Errorf("%s: Add() twice = %q, want %q", tc.desc, got, tc.want)
+		}
+		f.Remove(ip, "gohome")
+		want := tc.hosts
+		if tc.removed != "" {
+			want = tc.removed
+		}
+		if got := string(f.Bytes()); got != want {
+			t.Errorf("%s: Remove() after Add() = %q, want %q", tc.desc, got, want)
+		}
+	}
+}
+
+func TestAddConflict(t *testing.T) {
+	f := Parse([]byte("10.0.0.1 gohome\n"))
+	if err := f.Add(net.ParseIP("127.0.0.53"), "gohome", ""); err == nil {
+		t.Errorf("Add() of a host with another entry succeeded: %q", f.Bytes())
+	}
+	f = Parse([]byte("# BEGIN gohome\n127.0.0.53 gohome\n"))
+	if err := f.Add(net.ParseIP("127.0.0.53"), "other", ""); err == nil {
+		t.Errorf("Add() with an unterminated block succeeded: %q", f.Bytes())
+	}
+}
+
+func TestRemoveOnlyAdded(t *testing.T) {
+	tests := []string{
+		// The user's own entries look like ours, but aren't in the block
+		"127.0.0.53 gohome\n",
+		"127.0.0.53 other gohome\n",
+		"127.0.0.53 gohome\n# BEGIN gohome\n127.0.0.53 other\n# END gohome\n",
+		"# BEGIN gohome\n127.0.0.53 gohome\n",
+	}
+	for _, tc := range tests {
+		f := Parse([]byte(tc))
+		if f.Remove(net.ParseIP("127.0.0.53"), "gohome") {
+			t.Errorf("Remove(%q) = true, want false", tc)
+		}
+		if got := string(f.Bytes()); got != tc {
+			t.Errorf("Remove(%q) changed the file to %q", tc, got)
+		}
+	}
+}
+
+func TestRemoveAfterEdit(t *testing.T) {
+	// The user edited the file after gohome added to it
+	f := Parse([]byte("127.0.0.53 other # mine\n"))
+	if err := f.Add(net.ParseIP("127.0.0.53"), "gohome", ""); err != nil {
+		t.Fatal(err)
+	}
+	f = Parse([]byte("10.0.0.1 new\n" + strings.Replace(string(f.Bytes()), "# mine", "another # mine", 1)))
+	if !f.Remove(net.ParseIP("127.0.0.53"), "gohome") {
+		t.Errorf("Remove() = false, want true")
+	}
+	want := "10.0.0.1 new\n127.0.0.53 other another # mine\n"
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("Remove() = %q, want %q", got, want)
+	}
+}
+
+func TestHostfile(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "hosts")
+	orig := []byte(testHosts)
+	if err := os.WriteFile(pth, orig, 0640); err != nil {
+		t.Fatal(err)
+	}
+	eh := &Hostfile{Filename: pth}
+	e, err := NewHostEntry("gohome", "127.0.0.53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := eh.HostExists("127.0.0.53"); ok || err != nil {
+		t.Errorf("HostExists() = %v, %v, want false", ok, err)
+	}
+	if err := eh.AddHost(e, "added by test"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := eh.HostExists("127.0.0.53"); !ok || err != nil {
+		t.Errorf("HostExists() after AddHost() = %v, %v, want true", ok, err)
+	}
+	if fi, err := os.Stat(pth); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("Stat() after AddHost() = %v, %v, want mode 0640", fi.Mode(), err)
+	}
+	if removed, err := eh.RemoveHost(e); !removed || err != nil {
+		t.Errorf("RemoveHost() = %v, %v, want true", removed, err)
+	}
+	if got, err := os.ReadFile(pth); err != nil || string(got) != string(orig) {
+		t.Errorf("After RemoveHost() the file is %q, %v, want %q", got, err, orig)
+	}
+	if removed, err := eh.RemoveHost(e); removed || err != nil {
+		t.Errorf("RemoveHost() again = %v, %v, want false", removed, err)
+	}
+}
@@ -39,3 +39,10 @@ func (l *LoopbackDarwin) Remove() error {
 	}
 	return nil
 }
+
+// Added is always true, as Remove removes the alias whether or not Add added it.
+func (l *LoopbackDarwin) Added() bool {
+	return true
+}
+
+func (l *LoopbackDarwin) Adopt() {}
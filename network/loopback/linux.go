@@ -4,38 +4,89 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os/exec"
 )
 
+// addrConn lists and changes the addresses of network interfaces: netlink on Linux, or a fake in tests.
+type addrConn interface {
+	Addrs(iface string) ([]net.IPNet, error)
+	AddAddr(iface string, addr net.IPNet) error
+	DelAddr(iface string, addr net.IPNet) error
+}
+
 type LoopbackLinux struct {
 	Alias     net.IP
 	Interface string
+
+	conn  addrConn // nil for netlink
+	added bool     // Whether Add added the alias, rather than it already existing
+}
+
+func (l *LoopbackLinux) addrConn() addrConn {
+	if l.conn == nil {
+		l.conn = netlinkConn{}
+	}
+	return l.conn
+}
+
+// aliasNet returns the alias as a single address network, as `ip addr add` without a prefix length does.
+func (l *LoopbackLinux) aliasNet() net.IPNet {
+	if ip4 := l.Alias.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: l.Alias, Mask: net.CIDRMask(128, 128)}
+}
+
+// Exists reports whether the alias is an address of the interface.
+func (l *LoopbackLinux) Exists() (bool, error) {
+	addrs, err := l.addrConn().Addrs(l.Interface)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(l.Alias) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (l *LoopbackLinux) Add() error {
 	ip := l.Alias.String()
-	log.Printf("Setting up loopback IP %s", ip)
-	c := exec.Command("ip", "addr", "replace", ip, "dev", l.Interface)
-	out, err := c.CombinedOutput()
+	exists, err := l.Exists()
 	if err != nil {
-		return fmt.Errorf("%s: %s %s", err, out, err)
+		return err
 	}
-	if len(out) != 0 {
-		return fmt.Errorf("ifconfig error: %s", out)
+	if exists {
+		// Configured by someone else, so it isn't removed either
+		log.Printf("Loopback IP %s already exists on %s", ip, l.Interface)
+		return nil
 	}
+	log.Printf("Setting up loopback IP %s", ip)
+	if err := l.addrConn().AddAddr(l.Interface, l.aliasNet()); err != nil {
+		return err
+	}
+	l.added = true
 	return nil
 }
 
+func (l *LoopbackLinux) Added() bool {
+	return l.added
+}
+
+func (l *LoopbackLinux) Adopt() {
+	l.added = true
+}
+
 func (l *LoopbackLinux) Remove() error {
 	ip := l.Alias.String()
-	log.Printf("Removing loopback IP %s", ip)
-	c := exec.Command("ip", "addr", "delete", ip, "dev", l.Interface)
-	out, err := c.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s: %s %s", err, out, err)
+	if !l.added {
+		log.Printf("Leaving loopback IP %s on %s, which gohome didn't add", ip, l.Interface)
+		return nil
 	}
-	if len(out) != 0 {
-		return fmt.Errorf("ifconfig error: %s", out)
+	log.Printf("Removing loopback IP %s", ip)
+	if err := l.addrConn().DelAddr(l.Interface, l.aliasNet()); err != nil {
+		return fmt.Errorf("Could not remove loopback IP %s: %w", ip, err)
 	}
+	l.added = false
 	return nil
 }
@@ -0,0 +1,112 @@
+package loopback
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+// fakeConn keeps addresses in memory, failing changes with EPERM unless privileged.
+type fakeConn struct {
+	addrs      map[string][]net.IPNet
+	privileged bool
+	calls      []string
+}
+
+func (c *fakeConn) Addrs(iface string) ([]net.IPNet, error) {
+	addrs, ok := c.addrs[iface]
+	if !ok {
+		return nil, errors.New("no such interface")
+	}
+	return slices.Clone(addrs), nil
+}
+
+func (c *fakeConn) AddAddr(iface string, addr net.IPNet) error {
+	c.calls = append(c.calls, "add "+addr.String())
+	if !c.privileged {
+		return &PermissionError{"add address", iface, syscall.EPERM}
+	}
+	c.addrs[iface] = append(c.addrs[iface], addr)
+	return nil
+}
+
+func (c *fakeConn) DelAddr(iface string, addr net.IPNet) error {
+	c.calls = append(c.calls, "del "+addr.String())
+	if !c.privileged {
+		return &PermissionError{"remove address", iface, syscall.EPERM}
+	}
+	c.addrs[iface] = slices.DeleteFunc(c.addrs[iface], func(a net.IPNet) bool { return a.String() == addr.String() })
+	return nil
+}
+
+func TestLoopbackLinux(t *testing.T) {
+	lo := []net.IPNet{{IP: net.ParseIP("127.0.0.1").To4(), Mask: net.CIDRMask(8, 32)}}
+	tests := []struct {
+		desc      string
+		alias     string
+		existing  []net.IPNet
+		wantCalls []string
+	}{
+		{"new IPv4", "127.0.0.53", nil, []string{"add 127.0.0.53/32", "del 127.0.0.53/32"}},
+		{"new IPv6", "fd00::53", nil, []string{"add fd00::53/128", "del fd00::53/128"}},
+		{"pre-existing", "127.0.0.53", []net.IPNet{{IP: net.ParseIP("127.0.0.53").To4(), Mask: net.CIDRMask(8, 32)}}, nil},
+	}
+	for _, tc := range tests {
+		c := &fakeConn{addrs: map[string][]net.IPNet{"lo": append(slices.Clone(lo), tc.existing...)}, privileged: true}
+		l := &LoopbackLinux{Alias: net.ParseIP(tc.alias), Interface: "lo", conn: c}
+		if err := l.Add(); err != nil {
+			t.Fatalf("%s: Add() failed: %s", tc.desc, err)
+		}
+		if ok, err := l.Exists(); !ok || err != nil {
+			t.Errorf("%s: Exists() after Add() = %v, %v, want true", tc.desc, ok, err)
+		}
+		if err := l.Remove(); err != nil {
+			t.Fatalf("%s: Remove() failed: %s", tc.desc, err)
+		}
+		if !slices.Equal(c.calls, tc.wantCalls) {
+			t.Errorf("%s: calls = %q, want %q", tc.desc, c.calls, tc.wantCalls)
+		}
+		// Pre-existing aliases are kept
+		if ok, _ := l.Exists(); ok != (tc.existing != nil) {
+			t.Errorf("%s: Exists() after Remove() = %v, want %v", tc.desc, ok, tc.existing != nil)
+		}
+	}
+}
+
+func TestLoopbackLinuxPermission(t *testing.T) {
+	c := &fakeConn{addrs: map[string][]net.IPNet{"lo": nil}}
+	l := &LoopbackLinux{Alias: net.ParseIP("127.0.0.53"), Interface: "lo", conn: c}
+	err := l.Add()
+	pe := (*PermissionError)(nil)
+	if !errors.As(err, &pe) || !errors.Is(err, syscall.EPERM) {
+		t.Errorf("Add() = %v, want a PermissionError", err)
+	}
+	// Nothing was added, so nothing is removed
+	if err := l.Remove(); err != nil || len(c.calls) != 1 {
+		t.Errorf("Remove() after a failed Add() = %v with calls %q, want nothing done", err, c.calls)
+	}
+}
+
+func TestLoopbackLinuxNoInterface(t *testing.T) {
+	l := &LoopbackLinux{Alias: net.ParseIP("127.0.0.53"), Interface: "lo9", conn: &fakeConn{addrs: map[string][]net.IPNet{}}}
+	if err := l.Add(); err == nil {
+		t.Errorf("Add() on a missing interface succeeded")
+	}
+}
+
+func TestLoopbackLinuxAdopt(t *testing.T) {
+	c := &fakeConn{addrs: map[string][]net.IPNet{"lo": {{IP: net.ParseIP("127.0.0.53").To4(), Mask: net.CIDRMask(32, 32)}}}, privileged: true}
+	l := &LoopbackLinux{Alias: net.ParseIP("127.0.0.53"), Interface: "lo", conn: c}
+	l.Adopt()
+	if err := l.Add(); err != nil || !l.Added() {
+		t.Fatalf("Add() after Adopt() = %v with Added() %v, want nil, true", err, l.Added())
+	}
+	if err := l.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := l.Exists(); ok || !slices.Equal(c.calls, []string{"del 127.0.0.53/32"}) {
+		t.Errorf("Remove() after Adopt() made calls %q, want the alias removed", c.calls)
+	}
+}
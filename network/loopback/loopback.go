@@ -9,6 +9,27 @@ import (
 type Loopback interface {
 	Add() error
 	Remove() error
+	// Added reports whether Remove will remove the alias.
+	Added() bool
+	// Adopt makes Remove remove the alias even if Add didn't add it, e.g. because a process that
+	// crashed did.
+	Adopt()
+}
+
+// PermissionError is returned when the process isn't allowed to change the interface's addresses,
+// e.g. without root or CAP_NET_ADMIN.
+type PermissionError struct {
+	Op        string
+	Interface string
+	Err       error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("Not permitted to %s on %s: %s", e.Op, e.Interface, e.Err)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
 }
 
 func New(ip string, iface string) (Loopback, error) {
@@ -20,7 +41,7 @@ func New(ip string, iface string) (Loopback, error) {
 	case "darwin":
 		return &LoopbackDarwin{nip, iface}, nil
 	case "linux":
-		return &LoopbackLinux{nip, iface}, nil
+		return &LoopbackLinux{Alias: nip, Interface: iface}, nil
 	}
 	return nil, fmt.Errorf("Runtime is %s - can't setup loopback", runtime.GOOS)
 }
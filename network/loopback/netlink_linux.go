@@ -0,0 +1,164 @@
+package loopback
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// netlinkConn manages addresses with rtnetlink(7), so iproute2 isn't needed.
+type netlinkConn struct{}
+
+var netlinkSeq atomic.Uint32
+
+func (netlinkConn) Addrs(iface string) ([]net.IPNet, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, netlinkError("list addresses", iface, os.NewSyscallError("netlinkrib", err))
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []net.IPNet{}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		if int(ifa.Index) != ifi.Index {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, err
+		}
+		var ip net.IP
+		for _, a := range attrs {
+			// IFA_LOCAL is the address of the interface; IFA_ADDRESS is the peer's on point-to-point links
+			if a.Attr.Type == syscall.IFA_LOCAL || a.Attr.Type == syscall.IFA_ADDRESS && ip == nil {
+				ip = net.IP(append([]byte{}, a.Value...))
+			}
+		}
+		if ip != nil {
+			addrs = append(addrs, net.IPNet{IP: ip, Mask: net.CIDRMask(int(ifa.Prefixlen), len(ip)*8)})
+		}
+	}
+	return addrs, nil
+}
+
+func (c netlinkConn) AddAddr(iface string, addr net.IPNet) error {
+	return c.changeAddr("add address", iface, addr, syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE)
+}
+
+func (c netlinkConn) DelAddr(iface string, addr net.IPNet) error {
+	return c.changeAddr("remove address", iface, addr, syscall.RTM_DELADDR, 0)
+}
+
+// changeAddr sends an RTM_NEWADDR or RTM_DELADDR request for addr and waits for it to be acknowledged.
+func (netlinkConn) changeAddr(op string, iface string, addr net.IPNet, typ uint16, flags uint16) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	family, ip := syscall.AF_INET6, addr.IP.To16()
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		family, ip = syscall.AF_INET, ip4
+	}
+	ones, _ := addr.Mask.Size()
+	scope := uint8(syscall.RT_SCOPE_UNIVERSE)
+	if addr.IP.IsLoopback() {
+		scope = syscall.RT_SCOPE_HOST
+	}
+
+	body := make([]byte, syscall.SizeofIfAddrmsg)
+	*(*syscall.IfAddrmsg)(unsafe.Pointer(&body[0])) = syscall.IfAddrmsg{
+		Family:    uint8(family),
+		Prefixlen: uint8(ones),
+		Scope:     scope,
+		Index:     uint32(ifi.Index),
+	}
+	body = appendRouteAttr(body, syscall.IFA_LOCAL, ip)
+	body = appendRouteAttr(body, syscall.IFA_ADDRESS, ip)
+
+	seq := netlinkSeq.Add(1)
+	msg := binary.NativeEndian.AppendUint32(nil, uint32(syscall.NLMSG_HDRLEN+len(body)))
+	msg = binary.NativeEndian.AppendUint16(msg, typ)
+	msg = binary.NativeEndian.AppendUint16(msg, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	msg = binary.NativeEndian.AppendUint32(msg, seq)
+	msg = binary.NativeEndian.AppendUint32(msg, 0)
+	msg = append(msg, body...)
+
+	if err := netlinkRequest(msg, seq); err != nil {
+		return netlinkError(op, iface, err)
+	}
+	return nil
+}
+
+// netlinkRequest sends msg on a new route socket and returns the error it is acknowledged with.
+func netlinkRequest(msg []byte, seq uint32) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Sendto(fd, msg, 0, sa); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("Short netlink acknowledgement")
+			}
+			if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
+
+func appendRouteAttr(b []byte, typ uint16, value []byte) []byte {
+	l := syscall.SizeofRtAttr + len(value)
+	b = binary.NativeEndian.AppendUint16(b, uint16(l))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = append(b, value...)
+	// Attributes are aligned to 4 bytes
+	for ; l%syscall.NLMSG_ALIGNTO != 0; l++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// netlinkError wraps err, returning a PermissionError if it is because of missing privileges.
+func netlinkError(op string, iface string, err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return &PermissionError{Op: op, Interface: iface, Err: err}
+	}
+	return fmt.Errorf("Could not %s on %s: %w", op, iface, err)
+}
@@ -0,0 +1,110 @@
+package loopback
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// inNetNamespace runs f in a new network namespace, skipping the test if one can't be created.
+// f runs on another goroutine, so it must not call t.Fatal.
+func inNetNamespace(t *testing.T, f func()) {
+	t.Helper()
+	unshared := make(chan error)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The thread stays in the namespace, so it exits with the goroutine instead of being reused
+		runtime.LockOSThread()
+		err := syscall.Unshare(syscall.CLONE_NEWNET)
+		unshared <- err
+		if err == nil {
+			f()
+		}
+	}()
+	if err := <-unshared; err != nil {
+		t.Skipf("Could not create a network namespace: %s", err)
+	}
+	<-done
+}
+
+func TestNetlinkNamespace(t *testing.T) {
+	inNetNamespace(t, func() {
+		l := &LoopbackLinux{Alias: net.ParseIP("127.0.0.53"), Interface: "lo"}
+		if ok, err := l.Exists(); ok || err != nil {
+			t.Errorf("Exists() = %v, %v, want false", ok, err)
+			return
+		}
+		if err := l.Add(); err != nil {
+			t.Errorf("Add() failed: %s", err)
+			return
+		}
+		if ok, err := l.Exists(); !ok || err != nil {
+			t.Errorf("Exists() after Add() = %v, %v, want true", ok, err)
+		}
+		ifi, err := net.InterfaceByName("lo")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		addrs, _ := ifi.Addrs()
+		found := false
+		for _, a := range addrs {
+			found = found || a.String() == "127.0.0.53/32"
+		}
+		if !found {
+			t.Errorf("Addresses of lo after Add() are %v, want 127.0.0.53/32", addrs)
+		}
+		if err := l.Remove(); err != nil {
+			t.Errorf("Remove() failed: %s", err)
+		}
+		if ok, err := l.Exists(); ok || err != nil {
+			t.Errorf("Exists() after Remove() = %v, %v, want false", ok, err)
+		}
+
+		// Addresses that were already there are kept
+		if err := (netlinkConn{}).AddAddr("lo", net.IPNet{IP: net.ParseIP("127.0.0.54").To4(), Mask: net.CIDRMask(32, 32)}); err != nil {
+			t.Error(err)
+			return
+		}
+		l = &LoopbackLinux{Alias: net.ParseIP("127.0.0.54"), Interface: "lo"}
+		if err := l.Add(); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := l.Remove(); err != nil {
+			t.Error(err)
+			return
+		}
+		if ok, _ := l.Exists(); !ok {
+			t.Errorf("Remove() removed a pre-existing address")
+		}
+
+		// Removing an address that doesn't exist fails
+		err = (netlinkConn{}).DelAddr("lo", net.IPNet{IP: net.ParseIP("127.0.0.55").To4(), Mask: net.CIDRMask(32, 32)})
+		if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			t.Errorf("DelAddr() of a missing address = %v, want %v", err, syscall.EADDRNOTAVAIL)
+		}
+	})
+}
+
+func TestNetlinkError(t *testing.T) {
+	tests := []struct {
+		err        error
+		permission bool
+	}{
+		{syscall.EPERM, true},
+		{os.NewSyscallError("socket", syscall.EACCES), true},
+		{syscall.EEXIST, false},
+	}
+	for _, tc := range tests {
+		err := netlinkError("add address", "lo", tc.err)
+		pe := (*PermissionError)(nil)
+		if errors.As(err, &pe) != tc.permission || !errors.Is(err, tc.err) {
+			t.Errorf("netlinkError(%v) = %#v, want permission error %v", tc.err, err, tc.permission)
+		}
+	}
+}
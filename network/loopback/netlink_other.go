@@ -0,0 +1,26 @@
+//go:build !linux
+
+package loopback
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// netlinkConn is only available on Linux.
+type netlinkConn struct{}
+
+func (netlinkConn) Addrs(iface string) ([]net.IPNet, error) {
+	return nil, fmt.Errorf("Runtime is %s - netlink requires linux", runtime.GOOS)
+}
+
+func (c netlinkConn) AddAddr(iface string, addr net.IPNet) error {
+	_, err := c.Addrs(iface)
+	return err
+}
+
+func (c netlinkConn) DelAddr(iface string, addr net.IPNet) error {
+	_, err := c.Addrs(iface)
+	return err
+}
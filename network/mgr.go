@@ -3,6 +3,10 @@ package network
 import (
 	"errors"
 	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
 
 	"github.com/ebnull/gohome/network/hostfile"
 	"github.com/ebnull/gohome/network/loopback"
@@ -10,48 +14,123 @@ import (
 
 var flagLoopbackInterface = flag.String("loopback-interface", "lo0", "Specifies the loopback adapter interface for --auto mode")
 var flagHostfile = flag.String("hostfile", "/etc/hosts", "Specifies the location of the hostfile to edit for --auto mode")
+var flagStateFile = flag.String("autoconfig-state", "~/.cache/gohome_autoconfig.json", "The file recording the network changes made for --auto mode, so they are undone after a crash")
 
 type HostAliasManager struct {
-	lb loopback.Loopback
-	h  *hostfile.Hostfile
-	he *hostfile.HostEntry
+	// TakeOverPid is the pid of a gohome handing off to this one, whose changes are taken over
+	// while it is still running.
+	TakeOverPid int
+
+	lb    loopback.Loopback
+	iface string
+	h     *hostfile.Hostfile // nil if the hostfile isn't edited
+	he    *hostfile.HostEntry
+	state *StateFile
 }
 
-func NewAliasManager(host string, ip string) (*HostAliasManager, error) {
+// NewAliasManager returns a manager that aliases ip to the loopback interface and, if editHosts
+// is set, adds host to the hostfile. Without editHosts host must be resolved another way, e.g.
+// by a DNSServer.
+func NewAliasManager(host string, ip string, editHosts bool) (*HostAliasManager, error) {
 	lb, err := loopback.New(ip, *flagLoopbackInterface)
 	if err != nil {
 		return nil, err
 	}
-	eh := &hostfile.Hostfile{*flagHostfile}
+	var eh *hostfile.Hostfile
+	if editHosts {
+		eh = &hostfile.Hostfile{Filename: *flagHostfile}
+	}
 	he, err := hostfile.NewHostEntry(host, ip)
 	if err != nil {
 		return nil, err
 	}
-	return &HostAliasManager{lb, eh, he}, nil
+	return &HostAliasManager{lb: lb, iface: *flagLoopbackInterface, h: eh, he: he, state: &StateFile{Filename: *flagStateFile}}, nil
+}
+
+// reconcile undoes the changes left by gohome processes that exited without undoing them. The
+// parts that are the same as this manager's are adopted instead, so they are undone when it stops.
+func (am *HostAliasManager) reconcile() error {
+	_, err := am.state.Cleanup(am.TakeOverPid, func(c *Change) {
+		if c.IP != am.he.IP.String() {
+			return
+		}
+		if c.Interface == am.iface {
+			am.lb.Adopt()
+			c.Interface = ""
+		}
+		if am.h != nil && c.Hostfile == am.h.Filename && c.Host == am.he.Host {
+			// Left in place, so AddHost doesn't change anything
+			c.Hostfile = ""
+		}
+	})
+	return err
 }
 
+// Start makes the changes, recording them in the state file until the returned function undoes them.
 func (am *HostAliasManager) Start() (error, func() error) {
+	if err := am.reconcile(); err != nil {
+		log.Printf("%s\n", err)
+	}
+	c := Change{Pid: os.Getpid(), IP: am.he.IP.String()}
+	if started, err := processStarted(c.Pid); err == nil {
+		c.Started = started
+	} else {
+		log.Printf("Could not tell when gohome started; its network changes are only undone once its pid is unused: %s\n", err)
+	}
+	record := func() {
+		if err := am.state.Record(c); err != nil {
+			log.Printf("Could not record network changes in %s: %s\n", am.state.Filename, err)
+		}
+	}
+	// Only forgotten once everything is undone, so what remains is undone by the next start or --cleanup
+	forget := func(err error) error {
+		if err == nil {
+			err = am.state.Forget(c.Pid)
+		}
+		return err
+	}
+
 	err := am.lb.Add()
 	if err != nil {
 		return err, func() error { return nil }
 	}
+	if am.lb.Added() {
+		c.Interface = am.iface
+		record()
+	}
 	undo := func() error {
-		return am.lb.Remove()
+		return forget(am.lb.Remove())
 	}
-	he, err := am.h.HostExists(am.he.IP.String())
+	if am.h == nil {
+		return nil, undo
+	}
+	// Only what is added is removed again, so entries that already existed are kept
+	err = am.h.AddHost(am.he, "added by gohome; removed when it exits")
 	if err != nil {
 		return err, undo
 	}
-	if !he {
-		err = am.h.AddHost(am.he, "added by gohome")
-		if err != nil {
-			return err, undo
-		}
-	}
+	c.Hostfile, c.Host = am.h.Filename, am.he.Host
+	record()
 	return nil, func() error {
 		_, err := am.h.RemoveHost(am.he)
-		return errors.Join(undo(), err)
+		return forget(errors.Join(am.lb.Remove(), err))
+	}
+}
+
+// Check returns an error if Start couldn't make the changes because the interface doesn't exist
+// or the hostfile can't be written, without making them.
+func (am *HostAliasManager) Check() error {
+	if _, err := net.InterfaceByName(am.iface); err != nil {
+		return fmt.Errorf("Loopback interface %s: %w", am.iface, err)
+	}
+	if am.h == nil {
+		return nil
+	}
+	f, err := os.OpenFile(am.h.Filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
 	}
+	return f.Close()
 }
 
 func (am *HostAliasManager) Host() string {
@@ -0,0 +1,31 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// processStarted identifies when the process with pid started, by the boot and its start time
+// since boot. It returns an error matching os.ErrNotExist if there is no such process.
+func processStarted(pid int) (string, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", err
+	}
+	// The command name in parentheses may contain spaces and parentheses itself
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return "", fmt.Errorf("Could not parse /proc/%d/stat", pid)
+	}
+	// From the state, the third field; starttime is the 22nd
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 20 {
+		return "", fmt.Errorf("Could not parse /proc/%d/stat", pid)
+	}
+	boot, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(boot)) + "/" + fields[19], nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processStarted identifies when the process with pid started, by its start time. It returns an
+// error matching os.ErrNotExist if there is no such process.
+func processStarted(pid int) (string, error) {
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	started := strings.TrimSpace(string(out))
+	if ee := (*exec.ExitError)(nil); started == "" && errors.As(err, &ee) {
+		return "", fmt.Errorf("No process %d: %w", pid, os.ErrNotExist)
+	} else if err != nil {
+		return "", err
+	}
+	return started, nil
+}
@@ -0,0 +1,223 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+
+	"github.com/google/renameio/v2"
+
+	"github.com/ebnull/gohome/network/hostfile"
+	"github.com/ebnull/gohome/network/loopback"
+)
+
+// Change records the network changes made by one gohome process, so they can be undone if it
+// exits without undoing them, e.g. because it was killed or crashed.
+type Change struct {
+	Pid       int
+	Started   string `json:",omitempty"` // When the process with Pid started, as pids are reused
+	IP        string
+	Interface string `json:",omitempty"` // The loopback interface IP was added to, if gohome added it
+	Hostfile  string `json:",omitempty"` // The hosts file Host was added to, if it was edited
+	Host      string `json:",omitempty"`
+}
+
+// exited reports whether the process that made the change has exited. Pids are reused, e.g. after
+// a reboot, so a process with the pid that started at another time is another one. So is this
+// one, e.g. in a container where gohome is always pid 1.
+func (c Change) exited() bool {
+	if c.Pid == os.Getpid() {
+		return true
+	}
+	started, err := processStarted(c.Pid)
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	// Without a start time to compare, the process is assumed to still be running
+	return err == nil && c.Started != "" && started != c.Started
+}
+
+// Undo removes the loopback alias and hosts entry of the change, if they are still there.
+func (c Change) Undo() error {
+	ip := net.ParseIP(c.IP)
+	if ip == nil {
+		return fmt.Errorf("Invalid IP address %s", c.IP)
+	}
+	errs := []error{}
+	if c.Interface != "" {
+		if ok, err := hasAddr(c.Interface, ip); err != nil {
+			errs = append(errs, err)
+		} else if ok {
+			lb, err := loopback.New(c.IP, c.Interface)
+			if err == nil {
+				lb.Adopt()
+				err = lb.Remove()
+			}
+			errs = append(errs, err)
+		}
+	}
+	if c.Hostfile != "" {
+		_, err := (&hostfile.Hostfile{Filename: c.Hostfile}).RemoveHost(&hostfile.HostEntry{Host: c.Host, IP: ip})
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// hasAddr reports whether ip is an address of the interface. Addresses on loopback interfaces
+// don't survive a reboot, unlike hosts entries.
+func hasAddr(iface string, ip net.IP) (bool, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(addrs, func(a net.Addr) bool {
+		ipn, ok := a.(*net.IPNet)
+		return ok && ipn.IP.Equal(ip)
+	}), nil
+}
+
+// StateFile keeps the changes of every gohome process that hasn't undone them yet. It is removed
+// when there are none.
+type StateFile struct {
+	Filename string
+}
+
+func (s *StateFile) Read() ([]Change, error) {
+	b, err := os.ReadFile(s.Filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	changes := []Change{}
+	if err := json.Unmarshal(b, &changes); err != nil {
+		return nil, fmt.Errorf("Could not read %s: %w", s.Filename, err)
+	}
+	return changes, nil
+}
+
+func (s *StateFile) write(changes []Change) error {
+	if len(changes) == 0 {
+		err := os.Remove(s.Filename)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Filename), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(s.Filename, b, 0644)
+}
+
+// lock locks the state file until the returned function is called, as other gohome processes may
+// change it at the same time. It locks the directory, which doesn't have to be removed.
+func (s *StateFile) lock() (func(), error) {
+	dir := filepath.Dir(s.Filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not lock %s: %w", dir, err)
+	}
+	// Closing it unlocks it
+	return func() { f.Close() }, nil
+}
+
+// Record replaces the change of c.Pid with c.
+func (s *StateFile) Record(c Change) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	changes, err := s.Read()
+	if err != nil {
+		return err
+	}
+	changes = slices.DeleteFunc(changes, func(o Change) bool { return o.Pid == c.Pid })
+	return s.write(append(changes, c))
+}
+
+// Forget removes the change of pid once it is undone.
+func (s *StateFile) Forget(pid int) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	changes, err := s.Read()
+	if err != nil {
+		return err
+	}
+	return s.write(slices.DeleteFunc(changes, func(c Change) bool { return c.Pid == pid }))
+}
+
+// Cleanup undoes and forgets the changes of processes that have exited, or of takeOver if it
+// isn't 0, a process handing off to this one, returning them. If adopt isn't nil it is called
+// with each change first, and may clear the parts that the caller takes over so they aren't
+// undone. Changes that can't be undone are kept to be tried again.
+func (s *StateFile) Cleanup(takeOver int, adopt func(c *Change)) ([]Change, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	changes, err := s.Read()
+	if err != nil {
+		return nil, err
+	}
+	undone, kept, errs := []Change{}, []Change{}, []error{}
+	for _, c := range changes {
+		if !c.exited() && (takeOver == 0 || c.Pid != takeOver) {
+			kept = append(kept, c)
+			continue
+		}
+		if adopt != nil {
+			adopt(&c)
+		}
+		if c.Interface == "" && c.Hostfile == "" {
+			log.Printf("Taking over network changes left by gohome (pid %d) for %s\n", c.Pid, c.IP)
+		} else {
+			log.Printf("Undoing network changes left by gohome (pid %d) for %s\n", c.Pid, c.IP)
+		}
+		if err := c.Undo(); err != nil {
+			errs = append(errs, fmt.Errorf("Could not undo network changes left by gohome (pid %d): %w", c.Pid, err))
+			kept = append(kept, c)
+			continue
+		}
+		undone = append(undone, c)
+	}
+	if len(undone) > 0 {
+		errs = append(errs, s.write(kept))
+	}
+	return undone, errors.Join(errs...)
+}
+
+// Cleanup undoes the changes recorded in --autoconfig-state by gohome processes that have exited.
+func Cleanup() error {
+	undone, err := (&StateFile{Filename: *flagStateFile}).Cleanup(0, nil)
+	if len(undone) == 0 && err == nil {
+		log.Printf("No network changes to clean up in %s\n", *flagStateFile)
+	}
+	return err
+}
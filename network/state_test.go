@@ -0,0 +1,164 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ebnull/gohome/network/hostfile"
+)
+
+// exitedPid returns the pid of a process that has exited.
+func exitedPid(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("Could not run true: %s", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestStateFile(t *testing.T) {
+	s := &StateFile{Filename: filepath.Join(t.TempDir(), "state", "autoconfig.json")}
+	if changes, err := s.Read(); err != nil || changes != nil {
+		t.Fatalf("Read() of a missing file = %v, %v, want nil, nil", changes, err)
+	}
+	a := Change{Pid: 10, IP: "127.0.0.53", Interface: "lo"}
+	b := Change{Pid: 20, IP: "127.0.0.54", Hostfile: "/etc/hosts", Host: "gohome"}
+	for _, c := range []Change{a, b, {Pid: 10, IP: "127.0.0.55"}, a} {
+		if err := s.Record(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if changes, err := s.Read(); err != nil || !slices.Equal(changes, []Change{b, a}) {
+		t.Errorf("Read() = %v, %v, want %v", changes, err, []Change{b, a})
+	}
+	s.Forget(10)
+	s.Forget(20)
+	if _, err := os.Stat(s.Filename); !os.IsNotExist(err) {
+		t.Errorf("The state file still exists after forgetting every change: %v", err)
+	}
+}
+
+func TestStateFileCleanup(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	original := "127.0.0.1 localhost\n"
+	if err := os.WriteFile(hosts, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &hostfile.Hostfile{Filename: hosts}
+	for _, e := range []hostfile.HostEntry{{Host: "crashed", IP: net.ParseIP("127.0.0.53")}, {Host: "running", IP: net.ParseIP("127.0.0.54")}} {
+		if err := h.AddHost(&e, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &StateFile{Filename: filepath.Join(dir, "autoconfig.json")}
+	started, err := processStarted(os.Getppid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := Change{Pid: exitedPid(t), IP: "127.0.0.53", Hostfile: hosts, Host: "crashed"}
+	running := Change{Pid: os.Getppid(), Started: started, IP: "127.0.0.54", Hostfile: hosts, Host: "running"}
+	// An earlier process with this pid
+	earlier := Change{Pid: os.Getpid(), IP: "127.0.0.55", Hostfile: hosts, Host: "earlier"}
+	// A process before a reboot, whose pid is used by another one now
+	reused := Change{Pid: 1, Started: "before a reboot", IP: "127.0.0.56", Hostfile: hosts, Host: "reused"}
+	for _, c := range []Change{crashed, running, earlier, reused} {
+		s.Record(c)
+	}
+
+	undone, err := s.Cleanup(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(undone, []Change{crashed, earlier, reused}) {
+		t.Errorf("Cleanup() undid %v, want %v", undone, []Change{crashed, earlier, reused})
+	}
+	if changes, _ := s.Read(); !slices.Equal(changes, []Change{running}) {
+		t.Errorf("Changes after Cleanup() = %v, want %v", changes, []Change{running})
+	}
+	b, _ := os.ReadFile(hosts)
+	if strings.Contains(string(b), "crashed") || !strings.Contains(string(b), "running") {
+		t.Errorf("Hosts file after Cleanup() is %q, want only the entry of the running process", b)
+	}
+
+	// Adopted changes are forgotten, but not undone
+	adopted := Change{Pid: exitedPid(t), IP: "127.0.0.54", Hostfile: hosts, Host: "running"}
+	s.Record(adopted)
+	undone, err = s.Cleanup(0, func(c *Change) { c.Hostfile = "" })
+	if err != nil || len(undone) != 1 || undone[0].Pid != adopted.Pid {
+		t.Errorf("Cleanup() with adoption = %v, %v, want the adopted change", undone, err)
+	}
+	if b, _ := os.ReadFile(hosts); !strings.Contains(string(b), "running") {
+		t.Errorf("Cleanup() removed an adopted hosts entry: %q", b)
+	}
+
+	// The changes of a process handing off are taken over while it is running
+	undone, err = s.Cleanup(running.Pid, func(c *Change) { c.Hostfile = "" })
+	if err != nil || len(undone) != 1 || undone[0].Pid != running.Pid {
+		t.Errorf("Cleanup() taking over from pid %d = %v, %v, want its change", running.Pid, undone, err)
+	}
+	if changes, _ := s.Read(); len(changes) != 0 {
+		t.Errorf("Changes after taking over = %v, want none", changes)
+	}
+
+	h.RemoveHost(&hostfile.HostEntry{Host: "running", IP: net.ParseIP("127.0.0.54")})
+	if b, _ := os.ReadFile(hosts); string(b) != original {
+		t.Errorf("Hosts file is %q, want it restored to %q", b, original)
+	}
+}
+
+func TestStateFileConcurrentRecords(t *testing.T) {
+	s := &StateFile{Filename: filepath.Join(t.TempDir(), "autoconfig.json")}
+	wg := sync.WaitGroup{}
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Record(Change{Pid: 1000 + i, IP: "127.0.0.53"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if changes, err := s.Read(); err != nil || len(changes) != 20 {
+		t.Errorf("Read() after 20 concurrent records = %d changes, %v, want 20", len(changes), err)
+	}
+}
+
+func TestProcessStarted(t *testing.T) {
+	started, err := processStarted(os.Getpid())
+	if err != nil || started == "" {
+		t.Fatalf("processStarted() of this process = %q, %v", started, err)
+	}
+	if again, _ := processStarted(os.Getpid()); again != started {
+		t.Errorf("processStarted() of this process = %q, then %q", started, again)
+	}
+	if other, _ := processStarted(os.Getppid()); other == started {
+		t.Errorf("processStarted() of the parent process = %q, the same as this one", other)
+	}
+	if _, err := processStarted(exitedPid(t)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("processStarted() of an exited process = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestChangeUndoMissingAlias(t *testing.T) {
+	ifaces, _ := net.Interfaces()
+	i := slices.IndexFunc(ifaces, func(ifi net.Interface) bool { return ifi.Flags&net.FlagLoopback != 0 })
+	if i < 0 {
+		t.Skip("No loopback interface")
+	}
+	// Aliases don't survive a reboot, so one that is gone is already undone
+	c := Change{Pid: exitedPid(t), IP: "127.0.0.199", Interface: ifaces[i].Name}
+	if err := c.Undo(); err != nil {
+		t.Errorf("Undo() of a missing alias = %v, want nil", err)
+	}
+}
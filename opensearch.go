@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// openSearchDescription is an OpenSearch 1.1 description document, which lets browsers add gohome
+// as a search engine. See https://github.com/dewitt/opensearch.
+type openSearchDescription struct {
+	XMLName       xml.Name        `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string          `xml:"ShortName"`
+	Description   string          `xml:"Description"`
+	InputEncoding string          `xml:"InputEncoding"`
+	Urls          []openSearchUrl `xml:"Url"`
+}
+
+type openSearchUrl struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr,omitempty"`
+	Rel      string `xml:"rel,attr,omitempty"`
+	Template string `xml:"template,attr"`
+}
+
+// baseUrl returns the scheme and host the request was made to.
+func (g *goHttp) baseUrl() string {
+	scheme := "http"
+	if g.R.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + g.R.Host
+}
+
+func (g *goHttp) handleOpenSearch() error {
+	base := g.baseUrl()
+	d := openSearchDescription{
+		ShortName:     g.R.Host,
+		Description:   "Golinks on " + g.R.Host,
+		InputEncoding: "UTF-8",
+		Urls: []openSearchUrl{
+			{Type: "text/html", Method: "get", Template: base + "/_/search?q={searchTerms}&go=1"},
+			{Type: "application/x-suggestions+json", Method: "get", Rel: "suggestions", Template: base + "/_/api/suggest?q={searchTerms}"},
+			{Type: "application/opensearchdescription+xml", Rel: "self", Template: base + "/_/opensearch.xml"},
+		},
+	}
+	b, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	g.W.Header().Set("Content-Type", "application/opensearchdescription+xml; charset=utf-8")
+	g.W.WriteHeader(http.StatusOK)
+	_, err = g.W.Write(append([]byte(xml.Header), append(b, '\n')...))
+	return err
+}
+
+// handleSuggest serves link name suggestions for the query q in the OpenSearch suggestions format:
+// the query, then arrays of completions, descriptions and URLs.
+func (g *goHttp) handleSuggest(db *LinkDB) error {
+	q := strings.TrimSpace(g.R.URL.Query().Get("q"))
+	names, descriptions, urls := []string{}, []string{}, []string{}
+	if q != "" {
+		base := g.baseUrl()
+		for _, l := range db.FuzzyLookup(q) {
+			names = append(names, l.Display)
+			descriptions = append(descriptions, firstNonEmpty(l.Description, l.Destination))
+			urls = append(urls, base+(&url.URL{Path: "/" + l.Display}).EscapedPath())
+		}
+	}
+	b, err := json.Marshal([]any{q, names, descriptions, urls})
+	if err != nil {
+		return err
+	}
+	g.W.Header().Set("Content-Type", "application/x-suggestions+json; charset=utf-8")
+	g.W.WriteHeader(http.StatusOK)
+	_, err = g.W.Write(b)
+	return err
+}
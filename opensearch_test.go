@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenSearch(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://go/_/opensearch.xml", nil)
+	rr := httptest.NewRecorder()
+	g := goHttp{W: rr, R: req}
+	if err := g.handleOpenSearch(); err != nil {
+		t.Fatal(err)
+	}
+	d := openSearchDescription{}
+	if err := xml.Unmarshal(rr.Body.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	templates := map[string]string{}
+	for _, u := range d.Urls {
+		templates[u.Type] = u.Template
+	}
+	if got, want := templates["application/x-suggestions+json"], "http://go/_/api/suggest?q={searchTerms}"; got != want {
+		t.Errorf("suggestions template = %q, want %q", got, want)
+	}
+	if got, want := templates["text/html"], "http://go/_/search?q={searchTerms}&go=1"; got != want {
+		t.Errorf("search template = %q, want %q", got, want)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	db := &LinkDB{}
+	db.Update([]Link{
+		{Display: "wiki", Destination: "http://wiki.example.org"},
+		{Display: "team/wiki", Destination: "http://example.org/team", Description: "The team's wiki"},
+		{Display: "bugs", Destination: "http://bugs.example.org"},
+	})
+	req := httptest.NewRequest("GET", "http://go/_/api/suggest?q=wk", nil)
+	rr := httptest.NewRecorder()
+	g := goHttp{W: rr, R: req}
+	if err := g.handleSuggest(db); err != nil {
+		t.Fatal(err)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-suggestions+json; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var q string
+	var names, descriptions, urls []string
+	if err := json.Unmarshal(rr.Body.Bytes(), &[]any{&q, &names, &descriptions, &urls}); err != nil {
+		t.Fatal(err)
+	}
+	if q != "wk" || len(names) != 2 || names[0] != "wiki" || names[1] != "team/wiki" {
+		t.Errorf("suggestions = %q %q, want wk [wiki team/wiki]", q, names)
+	}
+	if len(urls) == 2 && (urls[1] != "http://go/team/wiki" || descriptions[1] != "The team's wiki") {
+		t.Errorf("second suggestion = %q, %q, want http://go/team/wiki, The team's wiki", urls[1], descriptions[1])
+	}
+
+	req = httptest.NewRequest("GET", "http://go/_/search?q=team/wiki&go=1", nil)
+	rr = httptest.NewRecorder()
+	g = goHttp{W: rr, R: req}
+	if err := g.handleSearch(db); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/team/wiki" {
+		t.Errorf("GET %s = HTTP %d to %q, want a redirect to /team/wiki", req.URL, rr.Code, rr.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// The privileged helper makes the network changes for --auto mode on behalf of an unprivileged
+// server. They talk over a local socket in JSON lines: the server sends a helperRequest and the
+// helper replies with a helperResponse. The helper only ever changes what its own flags say, so
+// the server can't ask for anything else, and undoes the changes when asked or when the server
+// disconnects, including when it crashes.
+type helperRequest struct {
+	Op string // "start", "stop", or "hosts" for the names of the current changes
+}
+
+type helperResponse struct {
+	Hosts []string `json:",omitempty"` // The names resolvable to --bind, after "start" or "hosts"
+	Error string   `json:",omitempty"`
+}
+
+// autoconfigFunc makes the network changes, returning the resolvable names and a function undoing them.
+type autoconfigFunc func() ([]string, func() error, error)
+
+// serveHelper answers the requests of one server on conn until it disconnects or ctx is done,
+// undoing any changes then.
+func serveHelper(ctx context.Context, conn io.ReadWriteCloser, start autoconfigFunc) error {
+	noop := func() error { return nil }
+	stop := noop
+	hosts := []string(nil)
+	defer func() {
+		if err := stop(); err != nil {
+			log.Printf("Could not undo network configuration: %s\n", err)
+		}
+	}()
+	context.AfterFunc(ctx, func() { conn.Close() })
+	dec, enc := json.NewDecoder(bufio.NewReader(conn)), json.NewEncoder(conn)
+	for {
+		req := helperRequest{}
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		resp := helperResponse{}
+		switch req.Op {
+		case "start":
+			if err := stop(); err != nil {
+				log.Printf("Could not undo network configuration: %s\n", err)
+			}
+			stop, hosts = noop, nil
+			h, s, err := start()
+			if err != nil {
+				resp.Error = err.Error()
+			} else {
+				hosts, stop = h, s
+				resp.Hosts = hosts
+			}
+		case "stop":
+			if err := stop(); err != nil {
+				resp.Error = err.Error()
+			}
+			stop, hosts = noop, nil
+		case "hosts":
+			resp.Hosts = hosts
+		default:
+			resp.Error = fmt.Sprintf("Unknown helper request '%s'", req.Op)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// runHelper runs --helper mode. With --helper-socket it serves servers connecting to that socket
+// one at a time until it is signaled, otherwise the single server connected to stdin, as when
+// started by the server itself or by inetd-style socket activation.
+func runHelper(start autoconfigFunc) error {
+	if os.Geteuid() != 0 {
+		log.Printf("The helper isn't running as root; network configuration will probably fail\n")
+	}
+	if *flagHelperSocket == "" {
+		// Signals are for the server, which asks the helper to stop or disconnects. The helper must
+		// outlive the server to undo its changes, also when the server's stderr is closed.
+		signal.Ignore(os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGPIPE)
+		conn, err := net.FileConn(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("--helper without --helper-socket must be connected to a socket on stdin: %w", err)
+		}
+		return serveHelper(context.Background(), conn, start)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Remove(*flagHelperSocket)
+	l, err := (&net.ListenConfig{}).Listen(ctx, "unix", *flagHelperSocket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	// Only root and --user may connect
+	if err := os.Chmod(*flagHelperSocket, 0600); err != nil {
+		return err
+	}
+	if *flagUser != "" {
+		uid, gid, _, err := lookupUser(*flagUser)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(*flagHelperSocket, uid, gid); err != nil {
+			return err
+		}
+	}
+	context.AfterFunc(ctx, func() { l.Close() })
+	log.Printf("Helper listening on %s\n", *flagHelperSocket)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := serveHelper(ctx, conn, start); err != nil {
+			log.Printf("Helper connection failed: %s\n", err)
+		}
+		conn.Close()
+	}
+}
+
+// helperClient is the server's connection to the helper.
+type helperClient struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+func newHelperClient(conn net.Conn) *helperClient {
+	return &helperClient{conn, json.NewDecoder(bufio.NewReader(conn)), json.NewEncoder(conn)}
+}
+
+// dialHelper connects to the helper on --helper-socket.
+func dialHelper(path string) (*helperClient, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to the helper: %w", err)
+	}
+	return newHelperClient(conn), nil
+}
+
+// spawnHelper starts this binary in --helper mode, connected by a socket pair. It keeps running
+// as root when the server drops its privileges.
+func spawnHelper() (*helperClient, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	parent, child := os.NewFile(uintptr(fds[0]), "helper"), os.NewFile(uintptr(fds[1]), "helper-child")
+	defer parent.Close()
+	defer child.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, append(os.Args[1:], "--helper", "--helper-socket=")...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = child, os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Could not start the helper: %w", err)
+	}
+	go cmd.Wait()
+	conn, err := net.FileConn(parent)
+	if err != nil {
+		return nil, err
+	}
+	return newHelperClient(conn), nil
+}
+
+func (c *helperClient) call(op string) (helperResponse, error) {
+	resp := helperResponse{}
+	if err := c.enc.Encode(helperRequest{op}); err != nil {
+		return resp, fmt.Errorf("Could not send to the helper: %w", err)
+	}
+	if err := c.dec.Decode(&resp); err != nil {
+		return resp, fmt.Errorf("Could not read from the helper: %w", err)
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("%s", resp.Error)
+	}
+	return resp, nil
+}
+
+// Start asks the helper to make the network changes, returning the resolvable names.
+func (c *helperClient) Start() ([]string, error) {
+	resp, err := c.call("start")
+	return resp.Hosts, err
+}
+
+// Hosts returns the names resolvable after the changes made so far, without changing anything, as
+// when a server takes over the connection from another one on SIGHUP.
+func (c *helperClient) Hosts() ([]string, error) {
+	resp, err := c.call("hosts")
+	return resp.Hosts, err
+}
+
+// Stop asks the helper to undo the network changes and disconnects.
+func (c *helperClient) Stop() error {
+	defer c.conn.Close()
+	_, err := c.call("stop")
+	return err
+}
+
+func lookupUser(name string) (int, int, []int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	groups := []int{gid}
+	gids, _ := u.GroupIds()
+	for _, g := range gids {
+		if n, err := strconv.Atoi(g); err == nil && n != gid {
+			groups = append(groups, n)
+		}
+	}
+	return uid, gid, groups, nil
+}
+
+// dropPrivileges switches to the user, dropping root and every capability.
+func dropPrivileges(name string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("--user %s requires starting as root", name)
+	}
+	uid, gid, groups, err := lookupUser(name)
+	if err != nil {
+		return fmt.Errorf("Invalid --user: %w", err)
+	}
+	if uid == 0 {
+		return fmt.Errorf("--user %s is root", name)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return os.NewSyscallError("setgroups", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return os.NewSyscallError("setgid", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return os.NewSyscallError("setuid", err)
+	}
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("Still root after switching to --user %s", name)
+	}
+	log.Printf("Running as %s (uid %d)\n", name, uid)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// fakeAutoconfig counts network changes made and undone.
+type fakeAutoconfig struct {
+	fail    bool
+	started int
+	stopped int
+}
+
+func (f *fakeAutoconfig) start() ([]string, func() error, error) {
+	if f.fail {
+		return nil, nil, errors.New("Not permitted")
+	}
+	f.started++
+	return []string{"gohome"}, func() error {
+		f.stopped++
+		return nil
+	}, nil
+}
+
+// startHelper serves a helper for f, returning a client connected to it and a channel closed
+// when the helper is done.
+func startHelper(t *testing.T, f *fakeAutoconfig) (*helperClient, chan struct{}) {
+	t.Helper()
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := serveHelper(context.Background(), server, f.start); err != nil {
+			t.Errorf("serveHelper() failed: %s", err)
+		}
+	}()
+	return newHelperClient(client), done
+}
+
+func TestHelper(t *testing.T) {
+	f := &fakeAutoconfig{}
+	c, done := startHelper(t, f)
+	hosts, err := c.Start()
+	if err != nil || !slices.Equal(hosts, []string{"gohome"}) {
+		t.Errorf("Start() = %q, %v, want [gohome]", hosts, err)
+	}
+	if hosts, err := c.Hosts(); err != nil || !slices.Equal(hosts, []string{"gohome"}) || f.started != 1 {
+		t.Errorf("Hosts() = %q, %v with %d started, want [gohome] and nothing changed", hosts, err, f.started)
+	}
+	// Starting again undoes the first changes
+	if _, err := c.Start(); err != nil || f.started != 2 || f.stopped != 1 {
+		t.Errorf("Start() again = %v with %d started and %d stopped, want 2 and 1", err, f.started, f.stopped)
+	}
+	if _, err := c.call("reboot"); err == nil {
+		t.Errorf("call(reboot) succeeded")
+	}
+	if err := c.Stop(); err != nil {
+		t.Errorf("Stop() = %v", err)
+	}
+	<-done
+	if f.stopped != 2 {
+		t.Errorf("%d changes were undone after Stop(), want 2", f.stopped)
+	}
+}
+
+func TestHelperDisconnect(t *testing.T) {
+	f := &fakeAutoconfig{}
+	c, done := startHelper(t, f)
+	if _, err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// As when the server crashes
+	c.conn.Close()
+	<-done
+	if f.stopped != 1 {
+		t.Errorf("%d changes were undone after disconnecting, want 1", f.stopped)
+	}
+}
+
+func TestHelperStartFails(t *testing.T) {
+	f := &fakeAutoconfig{fail: true}
+	c, done := startHelper(t, f)
+	if _, err := c.Start(); err == nil || err.Error() != "Not permitted" {
+		t.Errorf("Start() = %v, want the helper's error", err)
+	}
+	if err := c.Stop(); err != nil {
+		t.Errorf("Stop() after a failed Start() = %v", err)
+	}
+	<-done
+}
+
+func TestHelperSocket(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "helper.sock")
+	l, err := net.Listen("unix", pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f := &fakeAutoconfig{}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		serveHelper(context.Background(), conn, f.start)
+	}()
+	c, err := dialHelper(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts, err := c.Start(); err != nil || len(hosts) != 1 {
+		t.Errorf("Start() = %q, %v", hosts, err)
+	}
+	if err := c.Stop(); err != nil {
+		t.Errorf("Stop() = %v", err)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	retryBase = 30 * time.Second // Delay before the first retry after a failed fetch
+	retryMax  = time.Hour        // Upper bound for the retry delay
+)
+
+// errNotModified is returned by remoteFetcher.Fetch when the remote links have not changed.
+var errNotModified = errors.New("Remote golinks not modified")
+
+// remoteFetcher downloads links from a remote URL. It remembers the validators of the last
+// response to make conditional requests, and tracks failures to back off between attempts.
+type remoteFetcher struct {
+	URL     string
+	Client  *http.Client
+	MaxSize int64  // Maximum size of the response body in bytes
+	Format  string // The name of a linkImporter, or empty to choose one from the response
+	Auth    *remoteAuth
+
+	etag         string
+	lastModified string
+	freshUntil   time.Time // From Cache-Control max-age; don't refetch before this
+	failures     int
+}
+
+func newRemoteFetcher(url string, auth *remoteAuth) (*remoteFetcher, error) {
+	client := &http.Client{Timeout: *flagRemoteTimeout, CheckRedirect: auth.checkRedirect}
+	tc, err := auth.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tc != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tc
+		client.Transport = t
+	}
+	return &remoteFetcher{
+		URL:     url,
+		Client:  client,
+		MaxSize: *flagRemoteMaxSize,
+		Auth:    auth,
+	}, nil
+}
+
+// Fetch downloads and parses the remote links, returning errNotModified if they haven't changed since the last fetch.
+func (f *remoteFetcher) Fetch(ctx context.Context) ([]Link, error) {
+	links, err := f.fetch(ctx)
+	if err != nil && !errors.Is(err, errNotModified) {
+		f.failures++
+		return nil, err
+	}
+	f.failures = 0
+	return links, err
+}
+
+func (f *remoteFetcher) fetch(ctx context.Context) ([]Link, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptLinkTypes)
+	if f.Auth != nil {
+		if err := f.Auth.apply(req); err != nil {
+			return nil, fmt.Errorf("Could not authenticate to remote: %w", err)
+		}
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	r, err := f.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not download updated golinks: %w", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode == http.StatusNotModified {
+		f.updateFreshness(r)
+		return nil, errNotModified
+	}
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(r.Body, 256))
+		return nil, fmt.Errorf("Could not download updated golinks: HTTP %s: %s", r.Status, strings.TrimSpace(string(snippet)))
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, f.MaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Could not download updated golinks: %w", err)
+	}
+	if int64(len(body)) > f.MaxSize {
+		return nil, fmt.Errorf("Could not download updated golinks: response is larger than %d bytes", f.MaxSize)
+	}
+	links, err := importLinks(f.Format, r.Header.Get("Content-Type"), f.URL, body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse updated golinks: %w", err)
+	}
+	// Only remember validators once the body has been successfully parsed
+	f.etag = r.Header.Get("ETag")
+	f.lastModified = r.Header.Get("Last-Modified")
+	f.updateFreshness(r)
+	return links, nil
+}
+
+func (f *remoteFetcher) updateFreshness(r *http.Response) {
+	f.freshUntil = time.Time{}
+	for _, d := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+		switch strings.ToLower(k) {
+		case "no-cache", "no-store":
+			f.freshUntil = time.Time{}
+			return
+		case "max-age":
+			if secs, err := strconv.Atoi(strings.Trim(v, `"`)); err == nil && secs > 0 {
+				f.freshUntil = time.Now().Add(time.Duration(secs) * time.Second)
+			}
+		}
+	}
+}
+
+// NextDelay returns how long to wait before the next fetch. After failures this backs off
+// exponentially with jitter; otherwise it waits for interval or until the response is stale.
+func (f *remoteFetcher) NextDelay(interval time.Duration) time.Duration {
+	if f.failures > 0 {
+		d := retryMax
+		if f.failures < 20 { // Avoid overflow
+			d = min(retryMax, retryBase<<(f.failures-1))
+		}
+		// Equal jitter: between half and the full delay
+		return d/2 + rand.N(d/2+1)
+	}
+	return max(interval, time.Until(f.freshUntil))
+}
+
+// remoteSource is a remote to download links from, configured with --remote or --source.
+type remoteSource struct {
+	Name      string
+	URL       string
+	Priority  int           // Links from sources with a higher priority win when names conflict
+	Namespace string        // If set, prefixed to the name of every link from this source (e.g. "team" for team/...)
+	Interval  time.Duration // Zero to use --interval
+	Format    string        // The name of a linkImporter, or empty to detect the format
+	Auth      remoteAuth
+
+	fetcher  *remoteFetcher
+	snapshot []Link // The most recent links from this source, or nil if not yet downloaded
+}
+
+// parseSourceSpec parses a --source value of comma separated key=value pairs, e.g.
+// "name=team,url=https://example.org/links.csv,priority=10,namespace=team,interval=5m,format=csv".
+// Keys not specific to sources are handled by remoteAuth.parseOption.
+func parseSourceSpec(spec string) (*remoteSource, error) {
+	s := &remoteSource{}
+	for _, kv := range splitSourceSpec(spec) {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid source option '%s'; expected key=value", kv)
+		}
+		var err error
+		switch k {
+		case "name":
+			s.Name = v
+		case "url":
+			s.URL = v
+		case "priority":
+			s.Priority, err = strconv.Atoi(v)
+		case "namespace":
+			s.Namespace = strings.Trim(v, "/")
+		case "interval":
+			s.Interval, err = time.ParseDuration(v)
+		case "format":
+			if findImporter(v) == nil {
+				err = fmt.Errorf("unknown format '%s'", v)
+			}
+			s.Format = v
+		default:
+			var handled bool
+			handled, err = s.Auth.parseOption(k, v)
+			if !handled {
+				return nil, fmt.Errorf("Unknown source option '%s'", k)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid source option %s: %w", k, err)
+		}
+	}
+	if s.Name == "" || s.URL == "" {
+		return nil, fmt.Errorf("Source '%s' requires a name and url", spec)
+	}
+	if err := s.Auth.validate(); err != nil {
+		return nil, fmt.Errorf("Source %s: %w", s.Name, err)
+	}
+	if s.Name == originLocal {
+		return nil, fmt.Errorf("Source name '%s' is reserved", s.Name)
+	}
+	return s, nil
+}
+
+// splitSourceSpec splits spec into its options at commas. Header values and URLs may contain commas
+// themselves, so a comma in one that isn't followed by another option is part of it.
+func splitSourceSpec(spec string) []string {
+	options := []string{}
+	continues := false
+	for _, kv := range strings.Split(spec, ",") {
+		k, _, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		known, _ := (&remoteAuth{}).parseOption(k, "")
+		known = known || slices.Contains([]string{"name", "url", "priority", "namespace", "interval", "format"}, k)
+		if continues && !known {
+			options[len(options)-1] += "," + kv
+			continue
+		}
+		options = append(options, kv)
+		continues = k == "header" || k == "url"
+	}
+	return options
+}
+
+// sourceFlag collects the repeatable --source flag.
+type sourceFlag []*remoteSource
+
+func (f *sourceFlag) String() string {
+	names := []string{}
+	for _, s := range *f {
+		names = append(names, s.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *sourceFlag) Set(v string) error {
+	s, err := parseSourceSpec(v)
+	if err != nil {
+		return err
+	}
+	// Flags are parsed more than once, so replace rather than duplicate sources with the same name
+	for i, o := range *f {
+		if o.Name == s.Name {
+			(*f)[i] = s
+			return nil
+		}
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// applyNamespace returns links with their names prefixed by the source's namespace and their origin set to the source.
+func (s *remoteSource) applyNamespace(links []Link) []Link {
+	ret := make([]Link, 0, len(links))
+	for _, l := range links {
+		if s.Namespace != "" {
+			l.Display = s.Namespace + "/" + l.Display
+			l.Source = canonicalizeLink(l.Display)
+			aliases := []string{}
+			for _, a := range l.Aliases {
+				aliases = append(aliases, s.Namespace+"/"+a)
+			}
+			l.Aliases = aliases
+		} else {
+			maybeFixLinkSource(&l)
+		}
+		l.Origin = s.Name
+		ret = append(ret, l)
+	}
+	return ret
+}
+
+// remoteSet keeps a LinkDB in sync with every configured remote source.
+type remoteSet struct {
+	db      *LinkDB
+	mu      sync.Mutex      // Serializes merges
+	sources []*remoteSource // Ordered by descending priority
+	wg      sync.WaitGroup  // The periodic updates started by Run
+}
+
+func newRemoteSet(db *LinkDB, sources []*remoteSource) (*remoteSet, error) {
+	sources = slices.Clone(sources)
+	slices.SortStableFunc(sources, func(a, b *remoteSource) int { return b.Priority - a.Priority })
+	for _, s := range sources {
+		f, err := newRemoteFetcher(s.URL, &s.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("Source %s: %w", s.Name, err)
+		}
+		f.Format = s.Format
+		s.fetcher = f
+		lastSync.Add(s)
+	}
+	return &remoteSet{db: db, sources: sources}, nil
+}
+
+func (rs *remoteSet) origin(name string) originInfo {
+	for _, s := range rs.sources {
+		if s.Name == name {
+			return originInfo{s.Priority, true, s.snapshot != nil}
+		}
+	}
+	return originInfo{}
+}
+
+// Run downloads links from every source, initially (if the db is empty) and then periodically until ctx is done.
+func (rs *remoteSet) Run(ctx context.Context) {
+	// Not per source: once the first one fills the db, the others still need their links
+	initial := rs.db.Len() == 0
+	for _, s := range rs.sources {
+		if initial {
+			if err := rs.update(ctx, s); err != nil {
+				log.Printf("Error fetching inital golinks from %s: %s\n", s.Name, err)
+			}
+		}
+		rs.wg.Add(1)
+		go func(ctx context.Context) {
+			defer rs.wg.Done()
+			interval := s.Interval
+			if interval == 0 {
+				interval = *flagUpdateInterval
+			}
+			for {
+				delay := s.fetcher.NextDelay(interval)
+				if delay != interval {
+					log.Printf("Next golinks update from %s in %s\n", s.Name, delay.Round(time.Second))
+				}
+				select {
+				case <-time.After(delay):
+					if err := rs.update(ctx, s); err != nil {
+						log.Printf("Error fetching golinks from %s: %s\n", s.Name, err)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(ctx)
+	}
+}
+
+// Wait waits for the periodic updates to stop once the context passed to Run is done.
+func (rs *remoteSet) Wait() {
+	rs.wg.Wait()
+}
+
+// update downloads links from s and merges them with the other sources into the db.
+func (rs *remoteSet) update(ctx context.Context, s *remoteSource) error {
+	log.Printf("Updating golinks for %s from %s\n", s.Name, s.URL)
+	l, err := s.fetcher.Fetch(ctx)
+	if errors.Is(err, errNotModified) {
+		log.Printf("Golinks for %s are not modified\n", s.Name)
+		// Still a successful sync, with no changes
+		lastSync.Set(s.Name, LinkStat{[]Link{}, []Link{}, []Link{}, []linkCollision{}})
+		return nil
+	}
+	if err != nil {
+		lastSync.Fail(s.Name, err)
+		return err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s.snapshot = s.applyNamespace(l)
+	merged := []Link{}
+	collisions := []linkCollision{}
+	claimed := map[string]int{} // Source to index in merged
+	for _, src := range rs.sources {
+		links, cs := rs.db.resolveCollisions(src.snapshot, src.Name)
+		collisions = append(collisions, cs...)
+		for _, l := range links {
+			if i, ok := claimed[l.Source]; ok {
+				if merged[i].Display != l.Display {
+					collisions = append(collisions, linkCollision{l.Source, merged[i], []Link{l}, "priority", src.Name, time.Now()})
+				}
+				continue
+			}
+			claimed[l.Source] = len(merged)
+			merged = append(merged, l)
+		}
+	}
+	stat := rs.db.Sync(merged, rs.origin, *flagSync == "mirror")
+	rs.db.setCollisions("sync", append(collisions, stat.Collisions...))
+	lastSync.Set(s.Name, stat)
+	log.Printf("Synced %d golinks from %s (%d new, %d changed, %d removed)\n", len(l), s.Name, len(stat.Added), len(stat.Changed), len(stat.Removed))
+	for _, d := range []struct {
+		desc  string
+		links []Link
+	}{{"new", stat.Added}, {"changed", stat.Changed}, {"removed", stat.Removed}} {
+		if len(d.links) > 0 {
+			sample := []string{}
+			for _, l := range d.links[:min(5, len(d.links))] {
+				sample = append(sample, l.Display)
+			}
+			log.Printf("Sample (up to 5) of %s links: %s\n", d.desc, sample)
+		}
+	}
+	if len(stat.Added)+len(stat.Changed)+len(stat.Removed) > 0 {
+		removed := []string{}
+		for _, l := range stat.Removed {
+			removed = append(removed, l.Source)
+		}
+		err = rs.db.Save(slices.Concat(stat.Added, stat.Changed), removed)
+		if err != nil {
+			log.Printf("Could not write to cache: %s", err)
+		}
+	}
+	return nil
+}
+
+// syncStatus records the result of the most recent sync of a source.
+type syncStatus struct {
+	Name      string
+	URL       string
+	Priority  int
+	Namespace string
+	Time      time.Time // Of the last successful sync
+	Stat      LinkStat
+	Error     string // Of the last sync, if it failed
+}
+
+// syncStatuses records the status of every source for /_/api/sync.
+type syncStatuses struct {
+	mu      sync.Mutex
+	sources []*syncStatus
+}
+
+var lastSync = &syncStatuses{}
+
+func (ss *syncStatuses) get(name string) *syncStatus {
+	for _, s := range ss.sources {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (ss *syncStatuses) Add(s *remoteSource) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.sources = append(ss.sources, &syncStatus{Name: s.Name, URL: s.URL, Priority: s.Priority, Namespace: s.Namespace})
+	metrics.SyncFailures.Add(s.Name, 0)
+}
+
+func (ss *syncStatuses) Set(name string, stat LinkStat) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s := ss.get(name); s != nil {
+		s.Time = time.Now()
+		s.Stat = stat
+		s.Error = ""
+		metrics.SyncSuccess.Set(name, float64(s.Time.Unix()))
+	}
+}
+
+func (ss *syncStatuses) Fail(name string, err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s := ss.get(name); s != nil {
+		s.Error = err.Error()
+		metrics.SyncFailures.Add(name, 1)
+	}
+}
+
+func (ss *syncStatuses) MarshalJSON() ([]byte, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return json.Marshal(ss.sources)
+}
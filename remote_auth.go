@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// remoteAuth configures how to authenticate to a remote source.
+//
+// Secrets are only ever referenced by file or environment variable, so they don't end up
+// in the configuration file. They are read for every request so they may be rotated.
+type remoteAuth struct {
+	BearerFile string
+	BearerEnv  string
+
+	BasicUser         string
+	BasicPasswordFile string
+	BasicPasswordEnv  string
+
+	Headers []string // "Name:value"; ${VAR} in the value is expanded from the environment
+
+	CAFile   string // PEM bundle of CAs to trust in addition to the system roots
+	CertFile string // PEM client certificate for mutual TLS
+	KeyFile  string
+}
+
+// parseOption handles an authentication option from a source spec, returning false if k isn't one.
+func (a *remoteAuth) parseOption(k string, v string) (bool, error) {
+	switch k {
+	case "bearer-file":
+		a.BearerFile = v
+	case "bearer-env":
+		a.BearerEnv = v
+	case "basic-user":
+		a.BasicUser = v
+	case "basic-password-file":
+		a.BasicPasswordFile = v
+	case "basic-password-env":
+		a.BasicPasswordEnv = v
+	case "header":
+		if name, _, ok := strings.Cut(v, ":"); !ok || strings.TrimSpace(name) == "" {
+			return true, fmt.Errorf("Invalid header '%s'; expected Name:value", v)
+		}
+		a.Headers = append(a.Headers, v)
+	case "ca":
+		a.CAFile = v
+	case "cert":
+		a.CertFile = v
+	case "key":
+		a.KeyFile = v
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (a *remoteAuth) validate() error {
+	if (a.BearerFile != "" || a.BearerEnv != "") && a.BasicUser != "" {
+		return fmt.Errorf("Only one of bearer and basic authentication may be configured")
+	}
+	if a.BearerFile != "" && a.BearerEnv != "" {
+		return fmt.Errorf("Only one of bearer-file and bearer-env may be set")
+	}
+	if a.BasicPasswordFile != "" && a.BasicPasswordEnv != "" {
+		return fmt.Errorf("Only one of basic-password-file and basic-password-env may be set")
+	}
+	if (a.CertFile == "") != (a.KeyFile == "") {
+		return fmt.Errorf("Both cert and key are required for a client certificate")
+	}
+	return nil
+}
+
+// readSecret reads a secret from the file or environment variable, whichever is set.
+func readSecret(file string, env string) (string, error) {
+	if file != "" {
+		pth, err := expandPath(file)
+		if err != nil {
+			return "", err
+		}
+		b, err := os.ReadFile(pth)
+		if err != nil {
+			return "", fmt.Errorf("Could not read secret: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	v, ok := os.LookupEnv(env)
+	if !ok {
+		return "", fmt.Errorf("Environment variable %s is not set", env)
+	}
+	return strings.TrimSpace(v), nil
+}
+
+// apply adds credentials and headers to req.
+func (a *remoteAuth) apply(req *http.Request) error {
+	for _, h := range a.Headers {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(os.ExpandEnv(value)))
+	}
+	switch {
+	case a.BearerFile != "" || a.BearerEnv != "":
+		token, err := readSecret(a.BearerFile, a.BearerEnv)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case a.BasicUser != "":
+		password := ""
+		if a.BasicPasswordFile != "" || a.BasicPasswordEnv != "" {
+			var err error
+			password, err = readSecret(a.BasicPasswordFile, a.BasicPasswordEnv)
+			if err != nil {
+				return err
+			}
+		}
+		req.SetBasicAuth(a.BasicUser, password)
+	}
+	return nil
+}
+
+// checkRedirect is the CheckRedirect of the client: it doesn't send the configured headers to
+// another host, as the client only drops Authorization and cookies itself.
+func (a *remoteAuth) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		for _, h := range a.Headers {
+			name, _, _ := strings.Cut(h, ":")
+			req.Header.Del(strings.TrimSpace(name))
+		}
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS configuration for a custom CA or client certificate, or nil if neither is set.
+func (a *remoteAuth) tlsConfig() (*tls.Config, error) {
+	if a.CAFile == "" && a.CertFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if a.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pth, err := expandPath(a.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pem, err := os.ReadFile(pth)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", a.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if a.CertFile != "" {
+		certPath, err := expandPath(a.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		keyPath, err := expandPath(a.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
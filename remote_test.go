@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteFetcher(t *testing.T) {
+	status := http.StatusOK
+	body := `[{"Display": "a", "Destination": "http://a"}]`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` && status == http.StatusOK {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	f := &remoteFetcher{URL: srv.URL, Client: srv.Client(), MaxSize: 1024}
+	ctx := context.Background()
+
+	links, err := f.Fetch(ctx)
+	if err != nil || len(links) != 1 {
+		t.Fatalf("Fetch() = %v, %v; want 1 link", links, err)
+	}
+	if d := f.NextDelay(time.Minute); d < 59*time.Minute {
+		t.Errorf("NextDelay() = %s, want max-age of 1h to be honoured", d)
+	}
+
+	if _, err := f.Fetch(ctx); !errors.Is(err, errNotModified) {
+		t.Errorf("second Fetch() error = %v, want errNotModified", err)
+	}
+
+	status = http.StatusInternalServerError
+	body = "<html>oops</html>"
+	f.etag = ""
+	if _, err := f.Fetch(ctx); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Fetch() of HTTP 500 error = %v, want an HTTP error", err)
+	}
+	first := f.NextDelay(time.Minute)
+	if first < retryBase/2 || first > retryBase {
+		t.Errorf("NextDelay() after 1 failure = %s, want between %s and %s", first, retryBase/2, retryBase)
+	}
+	for range 30 {
+		f.Fetch(ctx)
+	}
+	if d := f.NextDelay(time.Minute); d < retryMax/2 || d > retryMax {
+		t.Errorf("NextDelay() after many failures = %s, want between %s and %s", d, retryMax/2, retryMax)
+	}
+
+	status = http.StatusOK
+	body = "[" + strings.Repeat(" ", 2048) + "]"
+	if _, err := f.Fetch(ctx); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("Fetch() of oversized body error = %v, want a size error", err)
+	}
+
+	body = "[]"
+	if _, err := f.Fetch(ctx); err != nil {
+		t.Errorf("Fetch() = %v, want success", err)
+	}
+	if f.failures != 0 {
+		t.Errorf("failures = %d after success, want 0", f.failures)
+	}
+}
+
+func TestRemoteSetPriority(t *testing.T) {
+	bodies := map[string]string{
+		"/company": `[{"Display": "wiki", "Destination": "http://company/wiki"}, {"Display": "hr", "Destination": "http://company/hr"}]`,
+		"/team":    `[{"Display": "wiki", "Destination": "http://team/wiki"}, {"Display": "oncall", "Destination": "http://team/oncall"}]`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(bodies[r.URL.Path]))
+	}))
+	defer srv.Close()
+
+	db := &LinkDB{}
+	rs, err := newRemoteSet(db, []*remoteSource{
+		{Name: "company", URL: srv.URL + "/company"},
+		{Name: "team", URL: srv.URL + "/team", Priority: 10},
+		{Name: "team-ns", URL: srv.URL + "/team", Namespace: "team"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, s := range rs.sources {
+		if err := rs.update(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		wantDest   string
+		wantOrigin string
+	}{
+		{"wiki", "http://team/wiki", "team"},
+		{"hr", "http://company/hr", "company"},
+		{"team/oncall", "http://team/oncall", "team-ns"},
+		{"team/wiki", "http://team/wiki", "team-ns"},
+	}
+	for _, tc := range tests {
+		l := db.Lookup(tc.name)
+		if l == nil || l.Destination != tc.wantDest || l.Origin != tc.wantOrigin {
+			t.Errorf("Lookup(%q) = %+v, want destination %s from %s", tc.name, l, tc.wantDest, tc.wantOrigin)
+		}
+	}
+
+	// When the higher priority source drops a link, the lower priority one takes over
+	bodies["/team"] = `[]`
+	if err := rs.update(ctx, rs.sources[0]); err != nil {
+		t.Fatal(err)
+	}
+	if l := db.Lookup("wiki"); l == nil || l.Origin != "company" {
+		t.Errorf("Lookup(wiki) = %+v, want the link from company", l)
+	}
+	if l := db.Lookup("oncall"); l != nil {
+		t.Errorf("Lookup(oncall) = %+v, want it removed", l)
+	}
+}
+
+func TestRemoteSetRunInitial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"Display": "` + strings.TrimPrefix(r.URL.Path, "/") + `", "Destination": "http://example.com"}]`))
+	}))
+	defer srv.Close()
+
+	db := &LinkDB{}
+	rs, err := newRemoteSet(db, []*remoteSource{
+		{Name: "first", URL: srv.URL + "/first", Priority: 10},
+		{Name: "second", URL: srv.URL + "/second"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rs.Run(ctx)
+	cancel()
+	rs.Wait()
+	// Every source is fetched initially, not only until the db has links
+	for _, name := range []string{"first", "second"} {
+		if l := db.Lookup(name); l == nil {
+			t.Errorf("Lookup(%q) = nil after Run(), want the link from source %s", name, name)
+		}
+	}
+}
+
+func TestRemoteSetNotModified(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`[{"Display": "a", "Destination": "http://a"}]`))
+	}))
+	defer srv.Close()
+
+	rs, err := newRemoteSet(&LinkDB{}, []*remoteSource{{Name: "not-modified", URL: srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := rs.update(ctx, rs.sources[0]); err != nil {
+		t.Fatal(err)
+	}
+	lastSync.Fail("not-modified", errors.New("earlier failure"))
+	status := func() syncStatus {
+		lastSync.mu.Lock()
+		defer lastSync.mu.Unlock()
+		return *lastSync.get("not-modified")
+	}
+	before := status()
+	time.Sleep(time.Millisecond)
+	if err := rs.update(ctx, rs.sources[0]); err != nil {
+		t.Fatal(err)
+	}
+	after := status()
+	if !after.Time.After(before.Time) || after.Error != "" {
+		t.Errorf("Sync status after HTTP 304 = %+v, want a new successful sync after %s", after, before.Time)
+	}
+	// The same shape as after a fetch
+	if b, _ := json.Marshal(after.Stat); strings.Contains(string(b), "null") {
+		t.Errorf("Sync stats after HTTP 304 = %s, want empty lists", b)
+	}
+}
+
+func TestSplitSourceSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"name=a,url=http://x", []string{"name=a", "url=http://x"}},
+		{"name=a,url=http://x/?q=1,2,header=Accept:a/b, c/d,header=X-Key:k", []string{"name=a", "url=http://x/?q=1,2", "header=Accept:a/b, c/d", "header=X-Key:k"}},
+		// Only header values and URLs continue
+		{"name=a,b,url=http://x", []string{"name=a", "b", "url=http://x"}},
+	}
+	for _, tc := range tests {
+		if got := splitSourceSpec(tc.spec); !slices.Equal(got, tc.want) {
+			t.Errorf("splitSourceSpec(%q) = %q, want %q", tc.spec, got, tc.want)
+		}
+	}
+	if _, err := parseSourceSpec("name=a,b,url=http://x"); err == nil {
+		t.Errorf("parseSourceSpec() with an option without a value succeeded, want an error")
+	}
+}
+
+func TestRemoteAuthRedirect(t *testing.T) {
+	got := map[string]string{}
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got["other"] = r.Header.Get("X-Api-Key")
+		w.Write([]byte("[]"))
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got[r.URL.Path] = r.Header.Get("X-Api-Key")
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, other.URL+"/links", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	f, err := newRemoteFetcher(srv.URL+"/moved", &remoteAuth{Headers: []string{"X-Api-Key: s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/moved": "s3cret", "/elsewhere": "s3cret", "other": ""}
+	if !maps.Equal(got, want) {
+		t.Errorf("X-Api-Key received = %q, want %q: only sent to the same host", got, want)
+	}
+}
+
+func TestRemoteAuth(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		switch {
+		case r.Header.Get("Authorization") == "Bearer s3cret" && r.Header.Get("X-Team") == "infra":
+		case user == "me" && pass == "hunter2":
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := filepath.Join(dir, "token")
+	if err := os.WriteFile(token, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_TEAM", "infra")
+	t.Setenv("TEST_PASSWORD", "hunter2")
+
+	tests := []struct {
+		desc    string
+		spec    string
+		wantErr bool
+	}{
+		{"no auth", "ca=" + ca, true},
+		{"untrusted", "bearer-file=" + token, true},
+		{"bearer and header", "ca=" + ca + ",bearer-file=" + token + ",header=X-Team:${TEST_TEAM}", false},
+		{"bearer without header", "ca=" + ca + ",bearer-file=" + token, true},
+		{"basic", "ca=" + ca + ",basic-user=me,basic-password-env=TEST_PASSWORD", false},
+		{"missing env", "ca=" + ca + ",basic-user=me,basic-password-env=TEST_NOPE", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			s, err := parseSourceSpec("name=test,url=" + srv.URL + "," + tc.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := newRemoteFetcher(s.URL, &s.Auth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Fetch(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Fetch() error = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	if _, err := parseSourceSpec("name=test,url=x,bearer-env=A,basic-user=b"); err == nil {
+		t.Errorf("parseSourceSpec with bearer and basic auth succeeded, want an error")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	searchPerPage    = 20
+	searchMaxPerPage = 100
+)
+
+// searchFields are the link fields searched, with the weight of a match in each.
+var searchFields = []struct {
+	Name   string
+	Weight int
+	Get    func(l *Link) string
+}{
+	{"Display", 8, func(l *Link) string { return l.Display }},
+	{"Aliases", 8, func(l *Link) string { return strings.Join(l.Aliases, " ") }},
+	{"Tags", 4, func(l *Link) string { return strings.Join(l.Tags, " ") }},
+	{"Owner", 4, func(l *Link) string { return l.Owner }},
+	{"Description", 2, func(l *Link) string { return l.Description }},
+	{"Destination", 1, func(l *Link) string { return l.Destination }},
+}
+
+// searchResult is a link matching a search, with the matching text of each field marked.
+type searchResult struct {
+	Link
+	Score     int
+	Highlight map[string]template.HTML // Escaped field values with matches wrapped in <mark>
+}
+
+// searchResults is a page of results.
+type searchResults struct {
+	Query   string
+	Total   int // Across all pages
+	Page    int // Starting at 1
+	PerPage int
+	Results []searchResult
+}
+
+func (r searchResults) Pages() int {
+	return (r.Total + r.PerPage - 1) / r.PerPage
+}
+
+// PrevPage returns the number of the previous page, or 0 if this is the first.
+func (r searchResults) PrevPage() int {
+	return min(r.Page-1, r.Pages())
+}
+
+// NextPage returns the number of the next page, or 0 if this is the last.
+func (r searchResults) NextPage() int {
+	if r.Page >= r.Pages() {
+		return 0
+	}
+	return r.Page + 1
+}
+
+// searchTerms splits a query into lowercase terms.
+func searchTerms(q string) []string {
+	terms := []string{}
+	for _, t := range strings.Fields(strings.ToLower(q)) {
+		if !slices.Contains(terms, t) {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// scoreField scores the occurrences of term in the lowercased field value v. A match at the
+// start of a word scores double, and a match of the whole value scores four times.
+func scoreField(v string, term string, weight int) int {
+	i := strings.Index(v, term)
+	if i < 0 {
+		return 0
+	}
+	if v == term {
+		return 4 * weight
+	}
+	for ; i >= 0; i = nextIndex(v, term, i) {
+		if r, _ := utf8.DecodeLastRuneInString(v[:i]); i == 0 || !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return 2 * weight
+		}
+	}
+	return weight
+}
+
+// nextIndex returns the index of the next occurrence of term in v after the one at i, or -1.
+func nextIndex(v string, term string, i int) int {
+	j := strings.Index(v[i+1:], term)
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// scoreLink returns the score of a link for the query terms, or 0 if any term doesn't match.
+func scoreLink(l *Link, terms []string) int {
+	score := 0
+	for _, t := range terms {
+		ts := 0
+		for _, f := range searchFields {
+			ts += scoreField(strings.ToLower(f.Get(l)), t, f.Weight)
+		}
+		// Also match names regardless of punctuation, as links are looked up
+		if ct := canonicalizeLink(t); ts == 0 && ct != "" && strings.Contains(l.Source, ct) {
+			ts = searchFields[0].Weight
+		}
+		if ts == 0 {
+			return 0
+		}
+		score += ts
+	}
+	if canonicalizeLink(strings.Join(terms, "")) == l.Source {
+		score += 100
+	}
+	return score
+}
+
+// highlight escapes v for HTML, wrapping each occurrence of any of terms in <mark>.
+func highlight(v string, terms []string) template.HTML {
+	lower := strings.ToLower(v)
+	if len(lower) != len(v) {
+		// Lowercasing changed the length so offsets don't match; don't highlight
+		return template.HTML(html.EscapeString(v))
+	}
+	marked := make([]bool, len(v))
+	for _, t := range terms {
+		for i := strings.Index(lower, t); i >= 0; i = nextIndex(lower, t, i) {
+			for j := i; j < i+len(t); j++ {
+				marked[j] = true
+			}
+		}
+	}
+	b := strings.Builder{}
+	for i := 0; i < len(v); {
+		j := i
+		for j < len(v) && marked[j] == marked[i] {
+			j++
+		}
+		if marked[i] {
+			b.WriteString("<mark>" + html.EscapeString(v[i:j]) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(v[i:j]))
+		}
+		i = j
+	}
+	return template.HTML(b.String())
+}
+
+// Search returns the links matching every term of the query, best first. Links with equal
+// scores are ordered by their use in the last 30 days, then by name.
+func (db *LinkDB) Search(q string) []searchResult {
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return []searchResult{}
+	}
+	now := time.Now()
+	results := []searchResult{}
+	popularity := map[string]uint64{}
+	for _, l := range db.All() {
+		score := scoreLink(&l, terms)
+		if score == 0 {
+			continue
+		}
+		hl := map[string]template.HTML{}
+		for _, f := range searchFields {
+			hl[f.Name] = highlight(f.Get(&l), terms)
+		}
+		results = append(results, searchResult{l, score, hl})
+		popularity[l.Source] = db.Clicks(l.Source).Since(now, 30)
+	}
+	slices.SortStableFunc(results, func(a, b searchResult) int {
+		if a.Score != b.Score {
+			return b.Score - a.Score
+		}
+		return -cmpUint(popularity[a.Source], popularity[b.Source])
+	})
+	return results
+}
+
+// search runs the query in the request's q parameter, returning the page given by page and n.
+func (g *goHttp) search(db *LinkDB) searchResults {
+	q := g.R.URL.Query()
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(q.Get("n"))
+	if err != nil || perPage < 1 {
+		perPage = searchPerPage
+	}
+	perPage = min(perPage, searchMaxPerPage)
+	all := db.Search(q.Get("q"))
+	start := min((page-1)*perPage, len(all))
+	end := min(start+perPage, len(all))
+	return searchResults{q.Get("q"), len(all), page, perPage, all[start:end]}
+}
+
+// handleSearch serves the search page. With go=1, as used by the OpenSearch description,
+// a query that is the name of a link redirects to the link instead.
+func (g *goHttp) handleSearch(db *LinkDB) error {
+	if q := strings.Trim(g.R.URL.Query().Get("q"), " /"); g.R.URL.Query().Get("go") == "1" && q != "" && !strings.ContainsAny(q, " \t") {
+		if l, _ := db.PrefixLookup(q); l != nil {
+			http.Redirect(g.W, g.R, (&url.URL{Path: "/" + q}).EscapedPath(), http.StatusFound)
+			return nil
+		}
+	}
+	res := g.search(db)
+	title := " - Search"
+	if res.Query != "" {
+		title = " - Search: " + res.Query
+	}
+	return executeTmpl(g.W, http.StatusOK, title, "search.tmpl", struct {
+		searchResults
+		Prefix string
+	}{res, g.R.Host})
+}
+
+func (g *goHttp) handleApiSearch(db *LinkDB) error {
+	if g.R.Method != http.MethodGet {
+		g.W.Header().Set("Allow", "GET")
+		return apiError(g.W, http.StatusMethodNotAllowed, "Method %s not allowed", g.R.Method)
+	}
+	return writeJson(g.W, http.StatusOK, g.search(db))
+}
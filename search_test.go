@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	db := &LinkDB{}
+	db.Update([]Link{
+		{Display: "wiki", Destination: "http://wiki.example.org", Owner: "docs-team"},
+		{Display: "team-wiki", Destination: "http://example.org/team", Description: "The team's wiki"},
+		{Display: "oncall", Destination: "http://pager.example.org", Owner: "sre", Description: "Who is on call for the wiki"},
+		{Display: "bugs", Destination: "http://bugs.example.org/<new>", Owner: "sre"},
+	})
+
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"wiki", []string{"wiki", "teamwiki", "oncall"}},
+		{"WIKI team", []string{"teamwiki", "wiki"}},
+		{"teamwiki", []string{"teamwiki"}},
+		{"sre", []string{"bugs", "oncall"}},
+		{"nothing", []string{}},
+		{"", []string{}},
+	}
+	for _, tc := range tests {
+		got := []string{}
+		for _, r := range db.Search(tc.q) {
+			got = append(got, r.Source)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("Search(%q) = %v, want %v", tc.q, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("Search(%q) = %v, want %v", tc.q, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		v     string
+		terms []string
+		want  template.HTML
+	}{
+		{"Team-Wiki", []string{"wiki"}, "Team-<mark>Wiki</mark>"},
+		{"abcabc", []string{"bc", "ca"}, "a<mark>bcabc</mark>"},
+		{"<b>wiki</b>", []string{"wiki"}, "&lt;b&gt;<mark>wiki</mark>&lt;/b&gt;"},
+		{"nothing", []string{"wiki"}, "nothing"},
+	}
+	for _, tc := range tests {
+		if got := highlight(tc.v, tc.terms); got != tc.want {
+			t.Errorf("highlight(%q, %q) = %q, want %q", tc.v, tc.terms, got, tc.want)
+		}
+	}
+}
+
+func TestApiSearchPages(t *testing.T) {
+	db := &LinkDB{}
+	db.Update([]Link{
+		{Display: "a1", Destination: "http://example.org/1"},
+		{Display: "a2", Destination: "http://example.org/2"},
+		{Display: "a3", Destination: "http://example.org/3"},
+	})
+	req := httptest.NewRequest("GET", "/_/api/search?q=example&n=2&page=2", nil)
+	rr := httptest.NewRecorder()
+	g := goHttp{W: rr, R: req}
+	if err := g.handleApiSearch(db); err != nil {
+		t.Fatal(err)
+	}
+	res := searchResults{}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 3 || res.Page != 2 || len(res.Results) != 1 || res.Results[0].Display != "a3" {
+		t.Errorf("GET %s = %+v, want page 2 with only a3 of 3", req.URL, res)
+	}
+	if res.NextPage() != 0 || res.PrevPage() != 1 {
+		t.Errorf("NextPage(), PrevPage() = %d, %d, want 0, 1", res.NextPage(), res.PrevPage())
+	}
+
+	req = httptest.NewRequest("GET", "/_/search?q=example&n=2", nil)
+	rr = httptest.NewRecorder()
+	g = goHttp{W: rr, R: req}
+	if err := g.handleSearch(db); err != nil {
+		t.Fatal(err)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, "http://<mark>example</mark>.org/1") || !strings.Contains(body, "page=2") {
+		t.Errorf("GET %s did not highlight matches and link to the next page:\n%s", req.URL, body)
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 )
@@ -67,13 +69,61 @@ func localNamesFromBind(ctx context.Context, addr net.Addr) ([]string, string) {
 	return n, port
 }
 
-func listen(ctx context.Context, addr string, hostnames []string) error {
-	log.Printf("Binding to %s\n", addr)
-	l, err := (&(net.ListenConfig{})).Listen(ctx, "tcp", addr)
+// httpListeners are the sockets served on. They are bound before privileges are dropped.
+type httpListeners struct {
+	Main     net.Listener
+	TLS      *tls.Config  // Serve HTTPS on Main if not nil
+	Redirect net.Listener // Plain HTTP redirecting to HTTPS on Main, or nil
+}
+
+// bindHttp binds --bind, and --redirect-bind if it is set, unless sockets for them were inherited.
+// handedOffCert, if not nil, has the certificate of the process handing off to this one, which is
+// served if this one can't load its own.
+func bindHttp(ctx context.Context, inherited []inheritedSocket, handedOffCert *os.File) (httpListeners, error) {
+	ls := httpListeners{}
+	var err error
+	ls.TLS, err = newTlsConfig(*flagTlsCert, *flagTlsKey, *flagTlsAuto, *flagTlsDir, tlsNames(*flagHostname, *flagBind))
+	if handedOffCert != nil {
+		if err != nil {
+			// E.g. with --user, as the files are only readable by root
+			log.Printf("%s; serving the certificate handed off instead\n", err)
+			var cert tls.Certificate
+			if cert, err = readCertPipe(handedOffCert); err == nil {
+				ls.TLS = serverTlsConfig(cert)
+			}
+		} else {
+			handedOffCert.Close()
+		}
+	}
+	if err != nil {
+		return ls, err
+	}
+	if len(inherited) > 0 {
+		return activatedHttp(ls, inherited)
+	}
+	log.Printf("Binding to %s\n", *flagBind)
+	ls.Main, err = (&(net.ListenConfig{})).Listen(ctx, "tcp", *flagBind)
 	if err != nil {
-		return err
+		return ls, err
 	}
-	log.Printf("Listening on http://%s\n", l.Addr())
+	if *flagRedirectBind != "" {
+		ls.Redirect, err = (&(net.ListenConfig{})).Listen(ctx, "tcp", *flagRedirectBind)
+		if err != nil {
+			ls.Main.Close()
+			return ls, err
+		}
+	}
+	return ls, nil
+}
+
+// listen serves HTTP on l until ctx is done, or HTTPS if tlsConfig is not nil.
+func listen(ctx context.Context, l net.Listener, hostnames []string, tlsConfig *tls.Config) error {
+	scheme, defaultPort := "http", ":80"
+	if tlsConfig != nil {
+		scheme, defaultPort = "https", ":443"
+		l = tls.NewListener(l, tlsConfig)
+	}
+	log.Printf("Listening on %s://%s\n", scheme, l.Addr())
 	bindNames, port := localNamesFromBind(ctx, l.Addr())
 	hostnames = append(hostnames, bindNames...)
 	printed := map[string]struct{}{}
@@ -84,19 +134,96 @@ func listen(ctx context.Context, addr string, hostnames []string) error {
 		}
 		printed[hn] = struct{}{}
 		lps := fmt.Sprintf(":%s", port)
-		if lps == ":80" {
+		if lps == defaultPort {
 			lps = ""
 		}
-		log.Printf("Resolvable at http://%s%s\n", hn, lps)
+		log.Printf("Resolvable at %s://%s%s\n", scheme, hn, lps)
 	}
-	s := &http.Server{Addr: l.Addr().String()}
+	s := &http.Server{Addr: l.Addr().String(), TLSConfig: tlsConfig}
+	notify(fmt.Sprintf("READY=1\nSTATUS=Listening on %s://%s", scheme, l.Addr()))
+	return serveUntilDone(ctx, s, l)
+}
+
+// serveUntilDone serves l with s until ctx is done, then finishes the running requests within
+// --shutdown-timeout and returns http.ErrServerClosed.
+func serveUntilDone(ctx context.Context, s *http.Server, l net.Listener) error {
+	conns := &connTracker{}
+	s.ConnState = conns.ConnState
+	shutdown := make(chan struct{})
 	go func() {
+		defer close(shutdown)
 		<-ctx.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		// Shutdown drops requests it hasn't read yet, so stop accepting and wait for the
+		// requests on accepted connections first
+		s.SetKeepAlivesEnabled(false)
+		l.Close()
+		deadline := time.Now().Add(*flagShutdownTimeout)
+		for conns.Busy(time.Now()) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
 		defer cancel()
-		s.Shutdown(ctx)
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("Could not finish every request within --shutdown-timeout: %s\n", err)
+			s.Close()
+		}
 	}()
-	return s.Serve(l)
+	err := s.Serve(l)
+	if ctx.Err() != nil {
+		// Serve returns right away, while requests are still running
+		<-shutdown
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+// connTracker follows the states of a server's connections, to tell when none will get a request.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]connState
+}
+
+type connState struct {
+	State http.ConnState
+	Since time.Time
+}
+
+// newConnGrace is how long a new connection may take to send its request while shutting down.
+const newConnGrace = time.Second
+
+func (t *connTracker) ConnState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = map[net.Conn]connState{}
+	}
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, c)
+	default:
+		t.conns[c] = connState{state, time.Now()}
+	}
+}
+
+// Busy reports whether a connection is handling a request at now, or was accepted too recently to
+// have sent one. Idle connections, and new ones that never sent a request like browsers'
+// preconnections, aren't busy.
+func (t *connTracker) Busy(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, cs := range t.conns {
+		if cs.State == http.StateActive || cs.State == http.StateNew && now.Sub(cs.Since) < newConnGrace {
+			return true
+		}
+	}
+	return false
+}
+
+// listenRedirect serves plain HTTP on l until ctx is done, redirecting every request to HTTPS on httpsAddr.
+func listenRedirect(ctx context.Context, l net.Listener, httpsAddr string) error {
+	log.Printf("Redirecting http://%s to HTTPS\n", l.Addr())
+	s := &http.Server{Addr: l.Addr().String(), Handler: httpsRedirect(httpsAddr)}
+	return serveUntilDone(ctx, s, l)
 }
 
 type bufWriter struct {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ebnull/gohome/build"
+	"github.com/google/renameio/v2"
+)
+
+// LinkStore persists links between runs.
+type LinkStore interface {
+	// Load returns every stored link.
+	Load() ([]Link, error)
+	// Save persists the given changes. all is the complete set of links after the change,
+	// for stores that can't write incrementally.
+	Save(all []Link, changed []Link, removed []string) error
+	// LoadClicks returns the stored click counts by link source.
+	LoadClicks() (map[string]ClickStats, error)
+	// SaveClicks persists click counts. all holds the counts of every existing link and changed
+	// lists the sources whose counts changed; counts of links not in all may be dropped.
+	SaveClicks(all map[string]ClickStats, changed []string) error
+	Close() error
+}
+
+// newLinkStore returns the LinkStore named by kind (as given to --store), persisting to path.
+func newLinkStore(kind string, path string) (LinkStore, error) {
+	switch kind {
+	case "json":
+		return &jsonStore{path}, nil
+	case "sqlite":
+		_, err := os.Stat(path)
+		created := os.IsNotExist(err)
+		s, err := openSqliteStore(path)
+		if err != nil {
+			return nil, err
+		}
+		// Carry over the links of an installation switching from the default JSON store
+		jsonPath := filepath.Join(filepath.Dir(path), filepath.Base(build.DefaultCache))
+		if !created || jsonPath == filepath.Clean(path) {
+			return s, nil
+		}
+		if err := s.importJson(jsonPath); err != nil {
+			// Remove the new database so the import is tried again on the next start
+			s.Close()
+			for _, suffix := range []string{"", "-wal", "-shm"} {
+				os.Remove(path + suffix)
+			}
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("Unknown store '%s'; expected 'json' or 'sqlite'", kind)
+}
+
+// jsonStore keeps links as a single JSON array in a file which is rewritten on every change.
+type jsonStore struct {
+	Path string
+}
+
+func (s *jsonStore) Load() ([]Link, error) {
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		log.Printf("Loaded 0 golinks from %s: %s\n", s.Path, err.Error())
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readLinks(f)
+}
+
+func (s *jsonStore) Save(all []Link, changed []Link, removed []string) error {
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	log.Printf("Writing %d golinks to %s\n", len(all), s.Path)
+	return renameio.WriteFile(s.Path, b, 0644)
+}
+
+// clicksPath is the file click counts are kept in, next to the links: golinks.json has golinks.clicks.json.
+func (s *jsonStore) clicksPath() string {
+	return strings.TrimSuffix(s.Path, filepath.Ext(s.Path)) + ".clicks.json"
+}
+
+func (s *jsonStore) LoadClicks() (map[string]ClickStats, error) {
+	b, err := os.ReadFile(s.clicksPath())
+	if os.IsNotExist(err) {
+		return map[string]ClickStats{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	clicks := map[string]ClickStats{}
+	return clicks, json.Unmarshal(b, &clicks)
+}
+
+func (s *jsonStore) SaveClicks(all map[string]ClickStats, changed []string) error {
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(s.clicksPath(), b, 0644)
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
+
+func (s *jsonStore) String() string {
+	return s.Path
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order to bring the schema up to date; PRAGMA user_version
+// records how many have been applied. Only ever append to this list.
+var sqliteMigrations = []string{
+	`CREATE TABLE links (
+		source      TEXT PRIMARY KEY,
+		display     TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		owner       TEXT NOT NULL DEFAULT ''
+	)`,
+	`ALTER TABLE links ADD COLUMN origin TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE clicks (
+		source    TEXT PRIMARY KEY,
+		total     INTEGER NOT NULL DEFAULT 0,
+		last_used INTEGER NOT NULL DEFAULT 0,
+		daily     TEXT NOT NULL DEFAULT '{}'
+	)`,
+	`ALTER TABLE links ADD COLUMN description TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE links ADD COLUMN tags TEXT NOT NULL DEFAULT '[]'`,
+	`ALTER TABLE links ADD COLUMN aliases TEXT NOT NULL DEFAULT '[]'`,
+	`ALTER TABLE links ADD COLUMN created TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE links ADD COLUMN updated TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE links ADD COLUMN author TEXT NOT NULL DEFAULT ''`,
+}
+
+// sqliteStore keeps links in an SQLite database, writing only the links that changed.
+// The database is opened in WAL mode so other processes may read it while gohome writes.
+type sqliteStore struct {
+	Path string
+	db   *sql.DB
+}
+
+func openSqliteStore(path string) (*sqliteStore, error) {
+	// Escape the path so characters such as '?' and '#' aren't taken as part of the query
+	dsn := url.URL{
+		Scheme:   "file",
+		Opaque:   url.PathEscape(path),
+		RawQuery: "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)",
+	}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	s := &sqliteStore{path, db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not migrate %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// importJson copies the links and clicks of the JSON store at path, if there is one, into s.
+func (s *sqliteStore) importJson(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	js := &jsonStore{path}
+	links, err := js.Load()
+	if err != nil {
+		return fmt.Errorf("Could not import %s: %w", path, err)
+	}
+	clicks, err := js.LoadClicks()
+	if err != nil {
+		return fmt.Errorf("Could not import %s: %w", js.clicksPath(), err)
+	}
+	for i, l := range links {
+		// Caches from before links had a source; Load canonicalizes the rest
+		if l.Source == "" {
+			links[i].Source = canonicalizeLink(l.Display)
+		}
+	}
+	log.Printf("Importing %d golinks from %s into %s\n", len(links), path, s.Path)
+	if err := s.Save(links, links, nil); err != nil {
+		return err
+	}
+	return s.SaveClicks(clicks, slices.Collect(maps.Keys(clicks)))
+}
+
+func (s *sqliteStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		// PRAGMA doesn't accept bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Load() ([]Link, error) {
+	rows, err := s.db.Query(`SELECT source, display, destination, owner, description, tags, aliases, created, updated, author, origin
+		FROM links ORDER BY source`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []Link{}
+	for rows.Next() {
+		l := Link{}
+		var tags, aliases, created, updated string
+		if err := rows.Scan(&l.Source, &l.Display, &l.Destination, &l.Owner, &l.Description, &tags, &aliases, &created, &updated, &l.Author, &l.Origin); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(tags), &l.Tags); err != nil {
+			return nil, fmt.Errorf("Invalid tags for %s: %w", l.Source, err)
+		}
+		if err := json.Unmarshal([]byte(aliases), &l.Aliases); err != nil {
+			return nil, fmt.Errorf("Invalid aliases for %s: %w", l.Source, err)
+		}
+		if l.Created, err = parseSqliteTime(created); err != nil {
+			return nil, fmt.Errorf("Invalid created time for %s: %w", l.Source, err)
+		}
+		if l.Updated, err = parseSqliteTime(updated); err != nil {
+			return nil, fmt.Errorf("Invalid updated time for %s: %w", l.Source, err)
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+func (s *sqliteStore) Save(all []Link, changed []Link, removed []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, src := range removed {
+		if _, err := tx.Exec("DELETE FROM links WHERE source = ?", src); err != nil {
+			return err
+		}
+	}
+	for _, l := range changed {
+		tags, err := json.Marshal(nonNil(l.Tags))
+		if err != nil {
+			return err
+		}
+		aliases, err := json.Marshal(nonNil(l.Aliases))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO links (source, display, destination, owner, description, tags, aliases, created, updated, author, origin)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (source) DO UPDATE SET display = excluded.display, destination = excluded.destination,
+				owner = excluded.owner, description = excluded.description, tags = excluded.tags, aliases = excluded.aliases,
+				created = excluded.created, updated = excluded.updated, author = excluded.author, origin = excluded.origin`,
+			l.Source, l.Display, l.Destination, l.Owner, l.Description, string(tags), string(aliases),
+			formatSqliteTime(l.Created), formatSqliteTime(l.Updated), l.Author, l.Origin)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Writing %d changed and %d removed golinks to %s\n", len(changed), len(removed), s.Path)
+	return tx.Commit()
+}
+
+// formatSqliteTime formats a time for a TEXT column, with the zero time as an empty string.
+func formatSqliteTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseSqliteTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func (s *sqliteStore) LoadClicks() (map[string]ClickStats, error) {
+	rows, err := s.db.Query("SELECT source, total, last_used, daily FROM clicks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clicks := map[string]ClickStats{}
+	for rows.Next() {
+		var src, daily string
+		var lastUsed int64
+		c := ClickStats{}
+		if err := rows.Scan(&src, &c.Total, &lastUsed, &daily); err != nil {
+			return nil, err
+		}
+		if lastUsed != 0 {
+			c.LastUsed = time.Unix(lastUsed, 0)
+		}
+		if err := json.Unmarshal([]byte(daily), &c.Daily); err != nil {
+			return nil, fmt.Errorf("Invalid daily clicks for %s: %w", src, err)
+		}
+		clicks[src] = c
+	}
+	return clicks, rows.Err()
+}
+
+func (s *sqliteStore) SaveClicks(all map[string]ClickStats, changed []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM clicks WHERE source NOT IN (SELECT source FROM links)"); err != nil {
+		return err
+	}
+	for _, src := range changed {
+		c := all[src]
+		daily, err := json.Marshal(c.Daily)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO clicks (source, total, last_used, daily) VALUES (?, ?, ?, ?)
+			ON CONFLICT (source) DO UPDATE SET total = excluded.total, last_used = excluded.last_used, daily = excluded.daily`,
+			src, c.Total, c.LastUsed.Unix(), string(daily))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteStore) String() string {
+	return s.Path
+}
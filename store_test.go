@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ebnull/gohome/build"
+)
+
+func TestLinkStores(t *testing.T) {
+	for _, kind := range []string{"json", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "links")
+			store, err := newLinkStore(kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db := &LinkDB{Store: store}
+			if err := db.Load(); err != nil {
+				t.Fatal(err)
+			}
+			a, _ := db.Put(Link{Display: "a", Destination: "http://a"})
+			b, _ := db.Put(Link{Display: "b", Destination: "http://b", Owner: "me", Description: "B", Tags: []string{"x", "y"}, Aliases: []string{"bee"}, Author: "you"})
+			if err := db.Save([]Link{a, b}, nil); err != nil {
+				t.Fatal(err)
+			}
+			b.Destination = "http://b2"
+			b, _ = db.Put(b)
+			db.RecordClick("a", time.Now())
+			db.RecordClick("b", time.Unix(1700000000, 0))
+			if err := db.SaveClicks(); err != nil {
+				t.Fatal(err)
+			}
+			db.Delete("a")
+			if err := db.Save([]Link{b}, []string{"a"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SaveClicks(); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err = newLinkStore(kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			got, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []Link{b}
+			if !slices.EqualFunc(got, want, Link.Equal) {
+				t.Errorf("Load() = %+v, want %+v", got, want)
+			}
+			clicks, err := store.LoadClicks()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(clicks) != 1 || clicks["b"].Total != 1 || !clicks["b"].LastUsed.Equal(time.Unix(1700000000, 0)) || clicks["b"].Daily["2023-11-14"] != 1 {
+				t.Errorf("LoadClicks() = %+v, want one click on b", clicks)
+			}
+		})
+	}
+}
+
+func TestReadLinksCompatible(t *testing.T) {
+	// A cache written before links had tags, aliases or timestamps
+	old := `[{"source": "foobar", "display": "Foo-Bar", "destination": "http://example.org", "owner": "Me"}]`
+	got, err := readLinks(strings.NewReader(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Link{{Source: "foobar", Display: "Foo-Bar", Destination: "http://example.org", Owner: "Me"}}
+	if !slices.EqualFunc(got, want, Link.Equal) {
+		t.Errorf("readLinks() = %+v, want %+v", got, want)
+	}
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); strings.Contains(s, "Tags") || strings.Contains(s, "Created") {
+		t.Errorf("json.Marshal() = %s, want unset fields omitted", s)
+	}
+}
+
+func TestSqliteStorePath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"links db", "a?b#c.db", "100%.db", "x&_pragma=query_only(1).db"} {
+		path := filepath.Join(dir, name)
+		store, err := openSqliteStore(path)
+		if err != nil {
+			t.Fatalf("openSqliteStore(%q) = %v", path, err)
+		}
+		if err := store.Save(nil, []Link{{Source: "a", Display: "a", Destination: "http://a"}}, nil); err != nil {
+			t.Errorf("Save() to %q = %v", path, err)
+		}
+		store.Close()
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Database for %q not created: %v", path, err)
+		}
+	}
+}
+
+func TestSqliteStoreImportsJson(t *testing.T) {
+	dir := t.TempDir()
+	js := &jsonStore{filepath.Join(dir, filepath.Base(build.DefaultCache))}
+	a := Link{Source: "a", Display: "a", Destination: "http://a", Tags: []string{"x"}, Aliases: []string{}}
+	b := Link{Display: "B", Destination: "http://b", Tags: []string{}, Aliases: []string{}}
+	if err := js.Save([]Link{a, b}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := js.SaveClicks(map[string]ClickStats{"a": {Total: 3, Daily: map[string]uint64{}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "golinks.db")
+	store, err := newLinkStore("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Source = "b"
+	if want := []Link{a, b}; !slices.EqualFunc(got, want, Link.Equal) {
+		t.Errorf("Load() after importing = %+v, want %+v", got, want)
+	}
+	clicks, err := store.LoadClicks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clicks["a"].Total != 3 {
+		t.Errorf("LoadClicks() after importing = %+v, want 3 clicks on a", clicks)
+	}
+	if err := store.Save(nil, nil, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// Only a new database imports, so links removed since stay removed
+	store, err = newLinkStore("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got, err := store.Load(); err != nil || len(got) != 0 {
+		t.Errorf("Load() after reopening = %+v, %v, want no links", got, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Integration with systemd: socket activation (sd_listen_fds(3)) and service notifications
+// (sd_notify(3)), including the watchdog. Without systemd these do nothing, except for sockets
+// handed off on SIGHUP.
+
+// listenFdsStart is the first file descriptor passed by socket activation, SD_LISTEN_FDS_START.
+var listenFdsStart = 3
+
+// inheritedSocket is a socket passed by socket activation, or by a process handing off to this
+// one, with its name: FileDescriptorName=, or "unknown".
+type inheritedSocket struct {
+	Name string
+	File *os.File
+}
+
+// inheritedSockets returns the sockets passed to this process, if any. The LISTEN_* variables
+// are unset, so the helper doesn't inherit them.
+func inheritedSockets() []inheritedSocket {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		os.Unsetenv(handoffEnv)
+	}()
+	if pid := os.Getenv("LISTEN_PID"); pid != strconv.Itoa(os.Getpid()) && (pid != "" || handoffPid() == 0) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	sockets := []inheritedSocket{}
+	for i := range n {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		sockets = append(sockets, inheritedSocket{name, os.NewFile(uintptr(fd), name)})
+	}
+	return sockets
+}
+
+// takeSocket removes the socket with the name from sockets, returning it or nil.
+func takeSocket(sockets []inheritedSocket, name string) (*os.File, []inheritedSocket) {
+	for i, s := range sockets {
+		if s.Name == name {
+			return s.File, slices.Delete(sockets, i, i+1)
+		}
+	}
+	return nil, sockets
+}
+
+// activatedHttp serves the inherited sockets: the one named "redirect" is --redirect-bind, and
+// the other one --bind. The files are closed.
+func activatedHttp(ls httpListeners, sockets []inheritedSocket) (httpListeners, error) {
+	listeners := []net.Listener{}
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	defer func() {
+		for _, s := range sockets {
+			s.File.Close()
+		}
+	}()
+	for _, s := range sockets {
+		l, err := net.FileListener(s.File)
+		if err != nil {
+			closeAll()
+			return httpListeners{}, fmt.Errorf("Inherited socket %s is not a stream socket: %w", s.Name, err)
+		}
+		listeners = append(listeners, l)
+		switch {
+		case s.Name == "redirect" && ls.Redirect == nil:
+			ls.Redirect = l
+		case s.Name != "redirect" && ls.Main == nil:
+			ls.Main = l
+		default:
+			closeAll()
+			return httpListeners{}, fmt.Errorf("Unexpected inherited socket %s (%s); expected one for --bind and one named 'redirect'", s.Name, l.Addr())
+		}
+	}
+	if ls.Main == nil {
+		closeAll()
+		return httpListeners{}, fmt.Errorf("No inherited socket for --bind, only 'redirect'")
+	}
+	if ls.Redirect != nil && ls.TLS == nil {
+		closeAll()
+		return httpListeners{}, fmt.Errorf("The inherited 'redirect' socket requires HTTPS on --bind; set --tls-cert or --tls-auto")
+	}
+	log.Printf("Using inherited %s instead of binding\n", ls.Main.Addr())
+	return ls, nil
+}
+
+// sdNotify sends a notification like "READY=1" to systemd, if it asked for them.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// Abstract socket names start with '@', which net handles
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notify is sdNotify, logging failures.
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Printf("Could not notify systemd: %s\n", err)
+	}
+}
+
+// watchdogInterval returns how often to ping the watchdog, half of WATCHDOG_USEC as recommended,
+// or 0 if it isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings the watchdog until ctx is done, as long as alive returns. If it hangs, e.g.
+// on a deadlock, systemd restarts the service.
+func runWatchdog(ctx context.Context, alive func()) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		alive()
+		notify("WATCHDOG=1")
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
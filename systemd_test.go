@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket points NOTIFY_SOCKET at a socket returned for reading the notifications.
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	addr := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", addr)
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("No notification: %s", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify() without NOTIFY_SOCKET = %v, want nil", err)
+	}
+	conn := fakeNotifySocket(t)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readNotification(t, conn); got != "READY=1" {
+		t.Errorf("Notification = %q, want %q", got, "READY=1")
+	}
+}
+
+func TestListenNotifies(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- listen(ctx, l, nil, nil) }()
+
+	want := "READY=1\nSTATUS=Listening on http://" + l.Addr().String()
+	if got := readNotification(t, conn); got != want {
+		t.Errorf("Notification = %q, want %q", got, want)
+	}
+	cancel()
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("listen() = %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 15 * time.Second},
+		{"30000000", pid, 15 * time.Second},
+		{"30000000", "1", 0},
+		{"0", "", 0},
+		{"x", "", 0},
+	}
+	for _, tc := range tests {
+		t.Setenv("WATCHDOG_USEC", tc.usec)
+		t.Setenv("WATCHDOG_PID", tc.pid)
+		if got := watchdogInterval(); got != tc.want {
+			t.Errorf("watchdogInterval() with WATCHDOG_USEC=%q WATCHDOG_PID=%q = %v, want %v", tc.usec, tc.pid, got, tc.want)
+		}
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	hang := make(chan struct{})
+	pings := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runWatchdog(ctx, func() {
+			if pings++; pings > 2 {
+				<-hang
+			}
+		})
+	}()
+	for range 2 {
+		if got := readNotification(t, conn); got != "WATCHDOG=1" {
+			t.Errorf("Notification = %q, want %q", got, "WATCHDOG=1")
+		}
+	}
+	// No more pings while hanging
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Errorf("Got a notification of %d bytes while hanging", n)
+	}
+	cancel()
+	close(hang)
+	<-done
+}
+
+func TestInheritedSockets(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+
+	// For another process
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if sockets := inheritedSockets(); sockets != nil {
+		t.Errorf("inheritedSockets() for another process = %v, want nil", sockets)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Errorf("inheritedSockets() didn't unset LISTEN_FDS")
+	}
+
+	tests := []struct {
+		desc string
+		env  []string
+	}{
+		{"socket activation", []string{"LISTEN_PID", strconv.Itoa(os.Getpid())}},
+		{"handoff", []string{handoffEnv, strconv.Itoa(os.Getppid())}},
+	}
+	for _, tc := range tests {
+		// Owned by the inherited socket
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		listenFdsStart = fd
+		t.Setenv(tc.env[0], tc.env[1])
+		t.Setenv("LISTEN_FDS", "1")
+		t.Setenv("LISTEN_FDNAMES", "http")
+		sockets := inheritedSockets()
+		if len(sockets) != 1 || sockets[0].Name != "http" || int(sockets[0].File.Fd()) != listenFdsStart {
+			t.Fatalf("%s: inheritedSockets() = %v, want the socket named http", tc.desc, sockets)
+		}
+		sockets[0].File.Close()
+		if _, ok := os.LookupEnv(tc.env[0]); ok {
+			t.Errorf("%s: inheritedSockets() didn't unset %s", tc.desc, tc.env[0])
+		}
+	}
+
+	ls, err := activatedHttp(httpListeners{}, []inheritedSocket{{"http", f}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Main.Close()
+	go func() {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := ls.Main.Accept()
+	if err != nil {
+		t.Fatalf("Accept() on the inherited socket failed: %s", err)
+	}
+	c.Close()
+}
+
+func TestActivatedHttp(t *testing.T) {
+	tests := []struct {
+		names   []string
+		https   bool
+		wantErr string
+	}{
+		{[]string{"unknown"}, false, ""},
+		{[]string{"redirect", "https"}, true, ""},
+		{[]string{"redirect", "http"}, false, "requires HTTPS"},
+		{[]string{"redirect"}, true, "No inherited socket for --bind"},
+		{[]string{"http", "other"}, false, "Unexpected inherited socket other"},
+	}
+	for _, tc := range tests {
+		sockets, addrs := []inheritedSocket{}, []string{}
+		for _, name := range tc.names {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := l.(*net.TCPListener).File()
+			l.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sockets, addrs = append(sockets, inheritedSocket{name, f}), append(addrs, l.Addr().String())
+		}
+		ls := httpListeners{}
+		if tc.https {
+			ls.TLS = &tls.Config{}
+		}
+		ls, err := activatedHttp(ls, sockets)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("activatedHttp(%q) = %v, want an error containing %q", tc.names, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("activatedHttp(%q) failed: %s", tc.names, err)
+			continue
+		}
+		if ls.Main.Addr().String() != addrs[len(addrs)-1] || (len(addrs) > 1) != (ls.Redirect != nil && ls.Redirect.Addr().String() == addrs[0]) {
+			t.Errorf("activatedHttp(%q) = %+v, want the last socket on --bind and the first on --redirect-bind", tc.names, ls)
+		}
+		ls.Main.Close()
+		if ls.Redirect != nil {
+			ls.Redirect.Close()
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	localCAValidity   = 10 * 365 * 24 * time.Hour
+	localCertValidity = 365 * 24 * time.Hour
+	localCertRenew    = 30 * 24 * time.Hour // Reissue certificates expiring sooner than this
+)
+
+// Files in --tls-dir
+const (
+	localCAFile      = "ca.pem"
+	localCAKeyFile   = "ca-key.pem"
+	localCertFile    = "cert.pem"
+	localCertKeyFile = "cert-key.pem"
+)
+
+// newTlsConfig returns the TLS configuration to serve with, or nil to serve plain HTTP.
+// The certificate is read from certFile and keyFile if given, otherwise with auto it is issued
+// for names by a local CA kept in dir.
+func newTlsConfig(certFile string, keyFile string, auto bool, dir string, names []string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case certFile != "":
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load --tls-cert and --tls-key: %w", err)
+		}
+	case auto:
+		cert, err = localCert(dir, names, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	return serverTlsConfig(cert), nil
+}
+
+func serverTlsConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+}
+
+// certPipe returns a pipe to read cert and its key from as PEM. A process handed off to reads it
+// with readCertPipe, as it may not be able to read the files the certificate was loaded from.
+func certPipe(cert tls.Certificate) (*os.File, error) {
+	b := []byte{}
+	for _, der := range cert.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	// Larger chains don't fit in the pipe's buffer
+	go func() {
+		defer w.Close()
+		w.Write(b)
+	}()
+	return r, nil
+}
+
+// readCertPipe reads a certificate written by certPipe from f, closing it.
+func readCertPipe(f *os.File) (tls.Certificate, error) {
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// The key is skipped when reading the certificates, and the other way around
+	return tls.X509KeyPair(b, b)
+}
+
+// localCert returns a certificate for names issued by the local CA in dir, creating the CA
+// and reissuing the certificate as needed.
+func localCert(dir string, names []string, now time.Time) (tls.Certificate, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	ca, caKey, err := loadOrCreateCA(dir, names, now)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPath, keyPath := filepath.Join(dir, localCertFile), filepath.Join(dir, localCertKeyFile)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil && localCertValid(cert.Leaf, ca, names, now) {
+		return cert, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Could not load %s; issuing a new certificate: %s\n", certPath, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tpl, err := certTemplate(names[0], now, localCertValidity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, n)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeKey(keyPath, key); err != nil {
+		return tls.Certificate{}, err
+	}
+	// Serve the CA too, so clients only need to trust it
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	if err := os.WriteFile(certPath, chain, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("Issued a certificate for %s, valid until %s\n", strings.Join(names, ", "), tpl.NotAfter.Format(time.DateOnly))
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+// localCertValid reports whether cert was issued by ca, covers every name and isn't about to expire.
+func localCertValid(cert *x509.Certificate, ca *x509.Certificate, names []string, now time.Time) bool {
+	if cert == nil || cert.CheckSignatureFrom(ca) != nil || now.Add(localCertRenew).After(cert.NotAfter) {
+		return false
+	}
+	return !slices.ContainsFunc(names, func(n string) bool { return cert.VerifyHostname(n) != nil })
+}
+
+// loadOrCreateCA loads the local CA from dir, creating it if it doesn't exist, has expired or
+// can't issue certificates for names. It can only issue certificates for names, so its key can't be
+// used to impersonate other sites.
+func loadOrCreateCA(dir string, names []string, now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	caPath, keyPath := filepath.Join(dir, localCAFile), filepath.Join(dir, localCAKeyFile)
+	pair, err := tls.LoadX509KeyPair(caPath, keyPath)
+	if err == nil {
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		switch {
+		case !ok || !now.Before(pair.Leaf.NotAfter):
+			log.Printf("The local CA in %s has expired or is unusable; creating a new one\n", caPath)
+		case !caPermits(pair.Leaf, names):
+			log.Printf("The local CA in %s can't issue certificates for %s; creating a new one\n", caPath, strings.Join(names, ", "))
+		default:
+			return pair.Leaf, key, nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("Could not load the local CA from %s: %w", dir, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _ := os.Hostname()
+	tpl, err := certTemplate(fmt.Sprintf("gohome local CA (%s)", host), now, localCAValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	tpl.IsCA = true
+	tpl.BasicConstraintsValid = true
+	tpl.MaxPathLenZero = true
+	tpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	tpl.PermittedDNSDomainsCritical = true
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip == nil {
+			tpl.PermittedDNSDomains = append(tpl.PermittedDNSDomains, n)
+		} else if ip4 := ip.To4(); ip4 != nil {
+			tpl.PermittedIPRanges = append(tpl.PermittedIPRanges, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			tpl.PermittedIPRanges = append(tpl.PermittedIPRanges, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeKey(keyPath, key); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Created a local CA in %s; add it to your browser or system trust store to trust gohome's certificate\n", caPath)
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// caPermits reports whether the name constraints of ca permit every name. CAs without
+// constraints, created before they were added, don't.
+func caPermits(ca *x509.Certificate, names []string) bool {
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			if !slices.ContainsFunc(ca.PermittedIPRanges, func(r *net.IPNet) bool { return r.Contains(ip) }) {
+				return false
+			}
+		} else if !slices.ContainsFunc(ca.PermittedDNSDomains, func(d string) bool { return n == d || strings.HasSuffix(n, "."+d) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func certTemplate(commonName string, now time.Time, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"gohome"}},
+		NotBefore:    now.Add(-time.Hour), // Allow for clock skew
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// writeKey writes key as PEM, readable only by the owner.
+func writeKey(pth string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pth, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// tlsNames returns the names the local certificate is issued for: the hostname and bind IP.
+func tlsNames(hostname string, bind string) []string {
+	names := []string{}
+	if hostname != "" {
+		names = append(names, hostname)
+	}
+	if host, _, err := net.SplitHostPort(bind); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			names = append(names, ip.String())
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, "localhost")
+	}
+	return names
+}
+
+// httpsRedirect redirects every request to the same URL over HTTPS on the port of httpsAddr.
+func httpsRedirect(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]") // No port
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6
+		}
+		// 308 so that API requests keep their method and body
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLocalCert(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	names := []string{"gohome", "127.0.0.53"}
+	cert, err := localCert(dir, names, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPem, err := os.ReadFile(filepath.Join(dir, localCAFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	for _, n := range names {
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: n, Roots: roots, CurrentTime: now}); err != nil {
+			t.Errorf("Verifying the certificate for %s: %s", n, err)
+		}
+	}
+	if len(cert.Certificate) != 2 {
+		t.Errorf("The certificate chain has %d certificates, want the leaf and CA", len(cert.Certificate))
+	}
+	for _, f := range []string{localCAKeyFile, localCertKeyFile} {
+		if fi, err := os.Stat(filepath.Join(dir, f)); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("Stat(%s) = %v, %v, want mode 0600", f, fi.Mode(), err)
+		}
+	}
+
+	tests := []struct {
+		desc   string
+		names  []string
+		now    time.Time
+		reused bool
+		newCA  bool // The CA can only issue certificates for the names it was created for
+	}{
+		{"same names", names, now, true, false},
+		{"subset of names", names[:1], now, true, false},
+		{"about to expire", names, now.Add(localCertValidity - localCertRenew/2), false, false},
+		{"new name", []string{"gohome", "go"}, now, false, true},
+	}
+	for _, tc := range tests {
+		got, err := localCert(dir, tc.names, tc.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reused := got.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0; reused != tc.reused {
+			t.Errorf("%s: reused = %v, want %v", tc.desc, reused, tc.reused)
+		}
+		if tc.newCA {
+			newPem, err := os.ReadFile(filepath.Join(dir, localCAFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(newPem) == string(caPem) {
+				t.Errorf("%s: the CA was kept, want a new one for the names", tc.desc)
+			}
+			caPem = newPem
+			roots = x509.NewCertPool()
+			roots.AppendCertsFromPEM(caPem)
+		}
+		if !tc.reused {
+			// Later certificates are issued by the current CA
+			if _, err := got.Leaf.Verify(x509.VerifyOptions{DNSName: tc.names[0], Roots: roots, CurrentTime: tc.now}); err != nil {
+				t.Errorf("%s: verifying the reissued certificate: %s", tc.desc, err)
+			}
+			cert = got
+		}
+	}
+}
+
+func TestLocalCANameConstraints(t *testing.T) {
+	now := time.Now()
+	names := []string{"gohome", "127.0.0.53"}
+	ca, caKey, err := loadOrCreateCA(t.TempDir(), names, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caPermits(ca, names) || caPermits(ca, []string{"example.com"}) || caPermits(ca, []string{"127.0.0.1"}) {
+		t.Errorf("The CA permits %v and %v, want only %v", ca.PermittedDNSDomains, ca.PermittedIPRanges, names)
+	}
+	if caPermits(&x509.Certificate{}, names) {
+		t.Errorf("caPermits() of a CA without name constraints = true, want false")
+	}
+
+	// A leaked key can't be used to impersonate other sites
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, n := range []string{"gohome", "example.com"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tpl, err := certTemplate(n, now, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tpl.DNSNames = []string{n}
+		der, err := x509.CreateCertificate(rand.Reader, tpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: n, Roots: roots, CurrentTime: now})
+		if want := n == "gohome"; (err == nil) != want {
+			t.Errorf("Verifying a certificate for %s issued by the CA = %v, want success %v", n, err, want)
+		}
+	}
+}
+
+func TestBindHttpHandedOffCert(t *testing.T) {
+	cfg, err := newTlsConfig("", "", true, t.TempDir(), []string{"gohome"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(cert, key, bind string) {
+		*flagTlsCert, *flagTlsKey, *flagBind = cert, key, bind
+	}(*flagTlsCert, *flagTlsKey, *flagBind)
+	// Like the files of a process handing off with --user, which are only readable by root
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	*flagTlsCert, *flagTlsKey, *flagBind = missing, missing, "127.0.0.1:0"
+
+	if _, err := bindHttp(context.Background(), nil, nil); err == nil {
+		t.Fatalf("bindHttp() with unreadable --tls-cert succeeded without a handed off certificate")
+	}
+	f, err := certPipe(cfg.Certificates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := bindHttp(context.Background(), nil, f)
+	if err != nil {
+		t.Fatalf("bindHttp() with a handed off certificate failed: %s", err)
+	}
+	defer ls.Main.Close()
+	if ls.TLS == nil || !slices.EqualFunc(ls.TLS.Certificates[0].Certificate, cfg.Certificates[0].Certificate, slices.Equal) {
+		t.Errorf("bindHttp() serves %+v, want the handed off certificate", ls.TLS)
+	}
+}
+
+func TestTlsNames(t *testing.T) {
+	tests := []struct {
+		hostname string
+		bind     string
+		want     []string
+	}{
+		{"gohome", "127.0.0.53:443", []string{"gohome", "127.0.0.53"}},
+		{"gohome", "0.0.0.0:443", []string{"gohome"}},
+		{"gohome", "[::1]:443", []string{"gohome", "::1"}},
+		{"", ":443", []string{"localhost"}},
+	}
+	for _, tc := range tests {
+		if got := tlsNames(tc.hostname, tc.bind); !slices.Equal(got, tc.want) {
+			t.Errorf("tlsNames(%q, %q) = %q, want %q", tc.hostname, tc.bind, got, tc.want)
+		}
+	}
+}
+
+func TestHttpsRedirect(t *testing.T) {
+	tests := []struct {
+		httpsAddr string
+		host      string
+		path      string
+		want      string
+	}{
+		{"127.0.0.53:443", "gohome", "/foo?a=b", "https://gohome/foo?a=b"},
+		{"127.0.0.53:443", "gohome:80", "/foo", "https://gohome/foo"},
+		{"127.0.0.53:8443", "gohome:8080", "/_/view", "https://gohome:8443/_/view"},
+		{"[::1]:443", "[::1]", "/foo", "https://[::1]/foo"},
+		{"[::1]:8443", "[::1]:80", "/foo", "https://[::1]:8443/foo"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("POST", tc.path, nil)
+		req.Host = tc.host
+		rr := httptest.NewRecorder()
+		httpsRedirect(tc.httpsAddr).ServeHTTP(rr, req)
+		if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Location") != tc.want {
+			t.Errorf("POST %s%s = %d %s, want %d %s", tc.host, tc.path, rr.Code, rr.Header().Get("Location"), http.StatusPermanentRedirect, tc.want)
+		}
+	}
+}
+
+func TestListenTls(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := newTlsConfig("", "", true, dir, []string{"gohome", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- listen(ctx, l, nil, cfg) }()
+
+	caPem, err := os.ReadFile(filepath.Join(dir, localCAFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.TLS == nil || len(resp.TLS.VerifiedChains) == 0 {
+		t.Errorf("GET https://%s was not verified by the local CA", addr)
+	}
+
+	cancel()
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("listen() = %v, want %v", err, http.ErrServerClosed)
+	}
+}